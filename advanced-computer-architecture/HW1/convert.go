@@ -0,0 +1,29 @@
+package main
+
+import (
+	"HW1/processor"
+	"fmt"
+	"os"
+)
+
+// runConvert expands a binary log into the CS470 JSON log.
+func runConvert(args []string) error {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "./OoO470 convert </path/to/input.bin> </path/to/output.json>")
+		os.Exit(2)
+	}
+
+	inFile, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	return processor.ConvertBinaryLog(inFile, outFile)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"HW1/processor"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type campaignReport map[processor.FaultTarget]map[processor.FaultOutcome]int
+
+func (r campaignReport) write(output io.Writer, targets []processor.FaultTarget) error {
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	header := []string{"structure", "injections"}
+	for _, outcome := range processor.AllFaultOutcomes {
+		header = append(header, string(outcome))
+	}
+	header = append(header, "avf")
+	fmt.Fprintln(w, strings.Join(header, "\t")+"\t")
+
+	for _, target := range targets {
+		outcomes := r[target]
+		total := 0
+		for _, n := range outcomes {
+			total += n
+		}
+
+		row := []string{string(target), fmt.Sprint(total)}
+		for _, outcome := range processor.AllFaultOutcomes {
+			row = append(row, fmt.Sprint(outcomes[outcome]))
+		}
+		// Every injection that is not masked is counted as architecturally visible.
+		avf := 0.
+		if total != 0 {
+			avf = float64(total-outcomes[processor.Masked]) / float64(total)
+		}
+		row = append(row, fmt.Sprintf("%.4f", avf))
+		fmt.Fprintln(w, strings.Join(row, "\t")+"\t")
+	}
+
+	return w.Flush()
+}
+
+func newLoadedProcessor(instructions []string) (*processor.Processor, error) {
+	proc := processor.New()
+	// The runs are only compared by their outcome.
+	proc.DisableLog()
+	return proc, proc.Load(instructions)
+}
+
+// runInject runs a fault-injection campaign and prints the outcome of every injection and an AVF report per structure.
+func runInject(args []string) error {
+	fs := flag.NewFlagSet("inject", flag.ExitOnError)
+	n := fs.Int("n", 1000, "number of injections per structure")
+	target := fs.String("target", "all", "structure to inject into: all, prf, rmt, iq or al")
+	seed := fs.Int64("seed", 1, "seed of the random fault coordinates")
+	cycle := fs.Int64("cycle", processor.Random, "cycle of the injection, random if negative")
+	index := fs.Int("index", processor.Random, "register or entry index, random if negative")
+	field := fs.Int("field", processor.Random, "entry field, random if negative")
+	bit := fs.Int("bit", processor.Random, "flipped bit, random if negative")
+	verbose := fs.Bool("v", false, "print the outcome of every injection")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "./OoO470 inject [flags] </path/to/input.json>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	targets := processor.AllFaultTargets
+	if *target != "all" {
+		targets = []processor.FaultTarget{processor.FaultTarget(*target)}
+	}
+
+	instructions, err := getInstructions(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	proc, err := newLoadedProcessor(instructions)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if err = proc.CheckFault(processor.Fault{Target: t, Index: *index, Field: *field, Bit: *bit}); err != nil {
+			return err
+		}
+	}
+	golden := proc.Run(^uint64(0))
+	if golden.Cycles == 0 {
+		return fmt.Errorf("the program runs no cycle, there is nothing to inject into")
+	}
+	if *cycle >= 0 && (*cycle == 0 || uint64(*cycle) > golden.Cycles) {
+		return fmt.Errorf("invalid fault, the program runs cycles 1 to %d: %d", golden.Cycles, *cycle)
+	}
+	// A faulty run taking much longer than the fault-free one is considered hung.
+	maxCycles := 2*golden.Cycles + 100
+
+	rng := rand.New(rand.NewSource(*seed))
+	report := make(campaignReport)
+	for _, t := range targets {
+		report[t] = make(map[processor.FaultOutcome]int)
+		for i := 0; i < *n; i++ {
+			fault := processor.Fault{
+				Target: t,
+				Cycle:  uint64(*cycle),
+				Index:  *index,
+				Field:  *field,
+				Bit:    *bit,
+			}
+			if *cycle < 0 {
+				fault.Cycle = uint64(rng.Int63n(int64(golden.Cycles))) + 1
+			}
+
+			proc, err = newLoadedProcessor(instructions)
+			if err != nil {
+				return err
+			}
+			proc.InjectFault(fault, rng)
+			faulty := proc.Run(maxCycles)
+
+			outcome := processor.Classify(golden, faulty)
+			if len(proc.AppliedFaults()) == 0 {
+				// The structure was empty, nothing to corrupt.
+				outcome = processor.Masked
+			}
+			report[t][outcome]++
+
+			if *verbose {
+				for _, applied := range proc.AppliedFaults() {
+					fmt.Printf("%s: %s\n", applied, outcome)
+				}
+			}
+		}
+	}
+
+	return report.write(os.Stdout, targets)
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"HW1/processor"
 	"encoding/json"
+	"flag"
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func getInstructions(path string) ([]string, error) {
@@ -29,24 +32,224 @@ func getInstructions(path string) ([]string, error) {
 	return instructions, nil
 }
 
+func getTrace(path string) ([]processor.TraceEntry, error) {
+	inFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	return processor.ReadTrace(inFile)
+}
+
+func writeStats(path string, stats processor.Stats) error {
+	if path == "-" {
+		return stats.Write(os.Stdout)
+	}
+
+	statsFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer statsFile.Close()
+
+	return stats.Write(statsFile)
+}
+
+type interruptCycles []uint64
+
+func (i *interruptCycles) String() string {
+	cycles := make([]string, len(*i))
+	for j, cycle := range *i {
+		cycles[j] = strconv.FormatUint(cycle, 10)
+	}
+	return strings.Join(cycles, ",")
+}
+
+func (i *interruptCycles) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		cycle, err := strconv.ParseUint(field, 0, 64)
+		if err != nil {
+			return err
+		}
+		*i = append(*i, cycle)
+	}
+	return nil
+}
+
+type interruptReporter struct {
+	processor.BaseObserver
+}
+
+func (interruptReporter) OnInterrupt(cycle uint64, pc uint64, raisedAt uint64) {
+	log.Printf("interrupt raised at cycle %d taken at cycle %d before PC %d, latency %d\n", raisedAt, cycle, pc, cycle-raisedAt)
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		log.Fatalln("./OoO470 </path/to/input.json> </path/to/output.json>")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sweep":
+			if err := runSweep(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		case "convert":
+			if err := runConvert(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		case "inject":
+			if err := runInject(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		case "serve":
+			if err := runServe(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
 	}
 
-	outFile, err := os.Create(os.Args[2])
+	model := flag.String("core", "r10k", "core model to simulate, one of: "+strings.Join(processor.Models, ", "))
+	cdbWidth := flag.Int("cdb-width", 2, "number of results broadcast per cycle by the tomasulo core")
+	statsPath := flag.String("stats", "", "write the performance counters to the given path, - for stdout")
+	format := flag.String("format", "json", "format of the output log: json, binary or text")
+	keyframe := flag.Uint64("keyframe", processor.DefaultKeyframeInterval, "cycles between two full states of the binary log")
+	vcdPath := flag.String("vcd", "", "write the pipeline waveforms as a VCD file to the given path")
+	commitLog := flag.String("commit-log", "", "write a Spike-compatible commit trace to the given path")
+	earlyRelease := flag.Bool("early-release", false, "free physical registers once they have no pending readers instead of at commit")
+	speculativeWakeup := flag.Bool("speculative-wakeup", false, "wake consumers before their producer completes and replay them on a miss")
+	missLatency := flag.Int("miss-latency", 0, "extra cycles of the traced loads that miss in the data cache")
+	clusters := flag.Int("clusters", 1, "number of clusters splitting the integer queue and the ALUs")
+	clusterDelay := flag.Int("cluster-delay", 0, "extra cycles of the values crossing clusters")
+	steering := flag.String("steering", string(processor.DependenceSteering), "steering policy of a clustered backend: round-robin or dependence")
+	trace := flag.Bool("trace", false, "the input is a dynamic instruction trace instead of a program")
+	var interrupts interruptCycles
+	flag.Var(&interrupts, "interrupt", "comma separated cycles at which an external interrupt is raised")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		log.Fatalln("./OoO470 [-core <model>] [-format json|binary|text] [-stats </path/to/stats.txt>] [-commit-log </path/to/commits.log>] [-vcd </path/to/waves.vcd>] [-interrupt <cycle,...>] [-early-release] [-speculative-wakeup] [-clusters <n> [-cluster-delay <cycles>] [-steering <policy>]] [-trace [-miss-latency <cycles>]] </path/to/input.json> </path/to/output.json>")
+	}
+
+	outFile, err := os.Create(flag.Arg(1))
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	instructions, err := getInstructions(os.Args[1])
+	core, err := processor.NewCore(*model)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	proc := processor.New()
+	if tomasulo, ok := core.(*processor.Tomasulo); ok {
+		tomasulo.SetCommonBusSize(*cdbWidth)
+	}
+
+	proc, isR10k := core.(*processor.Processor)
+	if !isR10k && (*commitLog != "" || *vcdPath != "" || *format != "json" || *trace || *earlyRelease || *speculativeWakeup || *clusters != 1) {
+		log.Fatalln("commit log, waveforms, traces, early release, speculative wakeup, clusters and other log formats are only supported by the r10k core")
+	}
+	if *missLatency < 0 {
+		log.Fatalln("invalid miss latency: " + strconv.Itoa(*missLatency))
+	}
+	if isR10k {
+		proc.SetEarlyRelease(*earlyRelease)
+		proc.SetSpeculativeWakeup(*speculativeWakeup)
+		proc.SetLoadMissLatency(*missLatency)
+		if err = proc.SetClusters(*clusters, *clusterDelay, processor.Steering(*steering)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var logObserver interface{ Err() error }
+	switch *format {
+	case "json":
+	case "binary":
+		binLog := processor.NewBinaryLogWriter(outFile, *keyframe)
+		proc.AddObserver(binLog)
+		proc.DisableLog()
+		logObserver = binLog
+	case "text":
+		textDump := processor.NewTextDumper(proc, outFile)
+		proc.AddObserver(textDump)
+		proc.DisableLog()
+		logObserver = textDump
+	default:
+		log.Fatalln("unknown log format: " + *format)
+	}
+
+	var tracer *processor.CommitTracer
+	if *commitLog != "" {
+		commitFile, err := os.Create(*commitLog)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer commitFile.Close()
+
+		tracer = processor.NewCommitTracer(proc, commitFile)
+		proc.AddObserver(tracer)
+	}
+
+	var waves *processor.VCDWriter
+	if *vcdPath != "" {
+		vcdFile, err := os.Create(*vcdPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer vcdFile.Close()
 
-	if err = proc.Simulate(instructions, outFile); err != nil {
+		waves = processor.NewVCDWriter(vcdFile)
+		proc.AddObserver(waves)
+	}
+
+	if *trace {
+		entries, err := getTrace(flag.Arg(0))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err = proc.LoadTrace(entries); err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		instructions, err := getInstructions(flag.Arg(0))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err = core.Load(instructions); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for _, cycle := range interrupts {
+		core.ScheduleInterrupt(cycle)
+	}
+	// The observers get a snapshot of the state every cycle, only watch the interrupts when there are some.
+	if isR10k && proc.InterruptsScheduled() {
+		proc.AddObserver(interruptReporter{})
+	}
+
+	for !core.Step() {
+	}
+
+	if logObserver != nil {
+		if logObserver.Err() != nil {
+			log.Fatalln(logObserver.Err())
+		}
+	} else if err = core.WriteLog(outFile); err != nil {
 		log.Fatalln(err)
 	}
+
+	if *statsPath != "" {
+		if err = writeStats(*statsPath, core.Stats()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if tracer != nil && tracer.Err() != nil {
+		log.Fatalln(tracer.Err())
+	}
+	if waves != nil && waves.Err() != nil {
+		log.Fatalln(waves.Err())
+	}
 }
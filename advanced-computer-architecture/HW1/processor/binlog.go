@@ -0,0 +1,419 @@
+package processor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// The binary log starts with binLogMagic and the number of physical registers, followed by one record per cycle.
+// A record is a flag byte, a mask of the fields present in it and the fields themselves.
+// Keyframes hold every field, the other records only the fields that changed since the previous cycle.
+const binLogMagic = "OoO470\x00\x01"
+
+const (
+	DefaultKeyframeInterval = 64
+
+	keyframeFlag = 1 << 0
+)
+
+const (
+	pcField = iota
+	physicalRegisterFileField
+	decodedPCsField
+	exceptionPCField
+	exceptionField
+	registerMapTableField
+	freeListField
+	busyBitTableField
+	activeListField
+	integerQueueField
+	stateFields
+)
+
+// BinaryLogWriter writes the state of every cycle in the compact binary log format.
+type BinaryLogWriter struct {
+	BaseObserver
+	output           *bufio.Writer
+	keyframeInterval uint64
+	prev             *State
+	err              error
+}
+
+func NewBinaryLogWriter(output io.Writer, keyframeInterval uint64) *BinaryLogWriter {
+	if keyframeInterval == 0 {
+		keyframeInterval = DefaultKeyframeInterval
+	}
+	return &BinaryLogWriter{
+		output:           bufio.NewWriter(output),
+		keyframeInterval: keyframeInterval,
+	}
+}
+
+func (w *BinaryLogWriter) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.output.Write(buf[:n])
+}
+
+func (w *BinaryLogWriter) bool(v bool) {
+	if v {
+		w.output.WriteByte(1)
+	} else {
+		w.output.WriteByte(0)
+	}
+}
+
+func (w *BinaryLogWriter) string(v string) {
+	w.uvarint(uint64(len(v)))
+	w.output.WriteString(v)
+}
+
+func (w *BinaryLogWriter) physReg(r PhysReg) {
+	w.uvarint(uint64(uint16(r)))
+}
+
+// values writes the (index, value) pairs that differ from prev, or all of them when prev is nil.
+func (w *BinaryLogWriter) values(curr []uint64, prev []uint64) {
+	var changed []int
+	for i := range curr {
+		if prev == nil || curr[i] != prev[i] {
+			changed = append(changed, i)
+		}
+	}
+	w.uvarint(uint64(len(changed)))
+	for _, i := range changed {
+		w.uvarint(uint64(i))
+		w.uvarint(curr[i])
+	}
+}
+
+func (w *BinaryLogWriter) field(field int, s *State, keyframe bool) {
+	var prev *State
+	if !keyframe {
+		prev = w.prev
+	}
+
+	switch field {
+	case pcField:
+		w.uvarint(s.PC)
+	case physicalRegisterFileField:
+		var prevPRF []uint64
+		if prev != nil {
+			prevPRF = prev.PhysicalRegisterFile
+		}
+		w.values(s.PhysicalRegisterFile, prevPRF)
+	case decodedPCsField:
+		w.uvarint(uint64(len(s.DecodedPCs)))
+		for _, pc := range s.DecodedPCs {
+			w.uvarint(pc)
+		}
+	case exceptionPCField:
+		w.uvarint(s.ExceptionPC)
+	case exceptionField:
+		w.bool(s.Exception)
+	case registerMapTableField:
+		curr := make([]uint64, len(s.RegisterMapTable))
+		for i, r := range s.RegisterMapTable {
+			curr[i] = uint64(uint16(r))
+		}
+		var prevRMT []uint64
+		if prev != nil {
+			prevRMT = make([]uint64, len(prev.RegisterMapTable))
+			for i, r := range prev.RegisterMapTable {
+				prevRMT[i] = uint64(uint16(r))
+			}
+		}
+		w.values(curr, prevRMT)
+	case freeListField:
+		w.uvarint(uint64(len(s.FreeList)))
+		for _, r := range s.FreeList {
+			w.physReg(r)
+		}
+	case busyBitTableField:
+		packed := make([]byte, (len(s.BusyBitTable)+7)/8)
+		for i, busy := range s.BusyBitTable {
+			if busy {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		w.output.Write(packed)
+	case activeListField:
+		w.uvarint(uint64(len(s.ActiveList)))
+		for _, ale := range s.ActiveList {
+			w.bool(ale.Done)
+			w.bool(ale.Exception)
+			w.uvarint(uint64(uint8(ale.LogicalDestination)))
+			w.physReg(ale.OldDestination)
+			w.uvarint(ale.PC)
+		}
+	case integerQueueField:
+		w.uvarint(uint64(len(s.IntegerQueue)))
+		for _, iqe := range s.IntegerQueue {
+			w.physReg(iqe.DestRegister)
+			w.bool(iqe.OpAIsReady)
+			w.physReg(iqe.OpARegTag)
+			w.uvarint(iqe.OpAValue)
+			w.bool(iqe.OpBIsReady)
+			w.physReg(iqe.OpBRegTag)
+			w.uvarint(iqe.OpBValue)
+			w.string(iqe.OpCode)
+			w.uvarint(iqe.PC)
+		}
+	}
+}
+
+func fieldChanged(field int, curr, prev *State) bool {
+	switch field {
+	case pcField:
+		return curr.PC != prev.PC
+	case physicalRegisterFileField:
+		return !reflect.DeepEqual(curr.PhysicalRegisterFile, prev.PhysicalRegisterFile)
+	case decodedPCsField:
+		return !reflect.DeepEqual(curr.DecodedPCs, prev.DecodedPCs)
+	case exceptionPCField:
+		return curr.ExceptionPC != prev.ExceptionPC
+	case exceptionField:
+		return curr.Exception != prev.Exception
+	case registerMapTableField:
+		return curr.RegisterMapTable != prev.RegisterMapTable
+	case freeListField:
+		return !reflect.DeepEqual(curr.FreeList, prev.FreeList)
+	case busyBitTableField:
+		return !reflect.DeepEqual(curr.BusyBitTable, prev.BusyBitTable)
+	case activeListField:
+		return !reflect.DeepEqual(curr.ActiveList, prev.ActiveList)
+	case integerQueueField:
+		return !reflect.DeepEqual(curr.IntegerQueue, prev.IntegerQueue)
+	default:
+		panic("unexpected field")
+	}
+}
+
+func (w *BinaryLogWriter) OnCycleEnd(s State) {
+	if w.err != nil {
+		return
+	}
+
+	if w.prev == nil {
+		w.output.WriteString(binLogMagic)
+		w.uvarint(uint64(len(s.PhysicalRegisterFile)))
+	}
+
+	keyframe := w.prev == nil || s.Cycle%w.keyframeInterval == 0
+	var mask uint64
+	for field := 0; field < stateFields; field++ {
+		if keyframe || fieldChanged(field, &s, w.prev) {
+			mask |= 1 << field
+		}
+	}
+
+	if keyframe {
+		w.output.WriteByte(keyframeFlag)
+	} else {
+		w.output.WriteByte(0)
+	}
+	w.uvarint(mask)
+	for field := 0; field < stateFields; field++ {
+		if mask&(1<<field) != 0 {
+			w.field(field, &s, keyframe)
+		}
+	}
+
+	w.prev = &s
+	w.err = w.output.Flush()
+}
+
+// Err returns the first error encountered while writing the log.
+func (w *BinaryLogWriter) Err() error {
+	return w.err
+}
+
+type binaryLogReader struct {
+	input     *bufio.Reader
+	curr      state
+	keyframed bool
+}
+
+func (r *binaryLogReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(r.input)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (r *binaryLogReader) byte() byte {
+	b, err := r.input.ReadByte()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (r *binaryLogReader) bool() bool {
+	return r.byte() != 0
+}
+
+func (r *binaryLogReader) string() string {
+	buf := make([]byte, r.uvarint())
+	if _, err := io.ReadFull(r.input, buf); err != nil {
+		panic(err)
+	}
+	return string(buf)
+}
+
+func (r *binaryLogReader) physReg() PhysReg {
+	return PhysReg(int16(uint16(r.uvarint())))
+}
+
+func (r *binaryLogReader) index(n int) int {
+	i := r.uvarint()
+	if i >= uint64(n) {
+		panic(fmt.Errorf("index out of range: %d", i))
+	}
+	return int(i)
+}
+
+func (r *binaryLogReader) field(field int) {
+	s := &r.curr
+	switch field {
+	case pcField:
+		s.PC = r.uvarint()
+	case physicalRegisterFileField:
+		for n := r.uvarint(); n > 0; n-- {
+			i := r.index(len(s.PhysicalRegisterFile))
+			s.PhysicalRegisterFile[i] = r.uvarint()
+		}
+	case decodedPCsField:
+		s.DecodedPCs = make([]uint64, r.uvarint())
+		for i := range s.DecodedPCs {
+			s.DecodedPCs[i] = r.uvarint()
+		}
+	case exceptionPCField:
+		s.ExceptionPC = r.uvarint()
+	case exceptionField:
+		s.Exception = r.bool()
+	case registerMapTableField:
+		for n := r.uvarint(); n > 0; n-- {
+			i := r.index(len(s.RegisterMapTable))
+			s.RegisterMapTable[i] = r.physReg()
+		}
+	case freeListField:
+		s.FreeList = make(freeList, r.uvarint())
+		for i := range s.FreeList {
+			s.FreeList[i] = r.physReg()
+		}
+	case busyBitTableField:
+		packed := make([]byte, (len(s.BusyBitTable)+7)/8)
+		if _, err := io.ReadFull(r.input, packed); err != nil {
+			panic(err)
+		}
+		for i := range s.BusyBitTable {
+			s.BusyBitTable[i] = packed[i/8]&(1<<(i%8)) != 0
+		}
+	case activeListField:
+		s.ActiveList = make(activeList, r.uvarint())
+		for i := range s.ActiveList {
+			ale := &s.ActiveList[i]
+			ale.Done = r.bool()
+			ale.Exception = r.bool()
+			ale.LogicalDestination = LogicReg(r.uvarint())
+			ale.OldDestination = r.physReg()
+			ale.PC = r.uvarint()
+		}
+	case integerQueueField:
+		s.IntegerQueue = make(integerQueue, r.uvarint())
+		for i := range s.IntegerQueue {
+			iqe := &s.IntegerQueue[i]
+			iqe.DestRegister = r.physReg()
+			iqe.OpAIsReady = r.bool()
+			iqe.OpARegTag = r.physReg()
+			iqe.OpAValue = r.uvarint()
+			iqe.OpBIsReady = r.bool()
+			iqe.OpBRegTag = r.physReg()
+			iqe.OpBValue = r.uvarint()
+			iqe.OpCode = r.string()
+			iqe.PC = r.uvarint()
+		}
+	}
+}
+
+// next decodes the following record, it returns io.EOF after the last one.
+func (r *binaryLogReader) next() (s state, err error) {
+	// The field readers panic on malformed input to keep the decoding straight-line.
+	defer func() {
+		if rec := recover(); rec != nil {
+			recErr, ok := rec.(error)
+			if !ok {
+				panic(rec)
+			}
+			if errors.Is(recErr, io.EOF) {
+				recErr = io.ErrUnexpectedEOF
+			}
+			err = fmt.Errorf("malformed binary log, %w", recErr)
+		}
+	}()
+
+	flags, err := r.input.ReadByte()
+	if err != nil {
+		return state{}, err
+	}
+	if flags&keyframeFlag == 0 && !r.keyframed {
+		return state{}, fmt.Errorf("malformed binary log, delta record before the first keyframe")
+	}
+	r.keyframed = true
+
+	mask := r.uvarint()
+	for field := 0; field < stateFields; field++ {
+		if mask&(1<<field) != 0 {
+			r.field(field)
+		}
+	}
+
+	return r.curr.copy(), nil
+}
+
+// ConvertBinaryLog expands a binary log into the CS470 JSON log, byte for byte equal to the one written by WriteLog.
+func ConvertBinaryLog(input io.Reader, output io.Writer) error {
+	r := binaryLogReader{input: bufio.NewReader(input)}
+
+	magic := make([]byte, len(binLogMagic))
+	if _, err := io.ReadFull(r.input, magic); err != nil || string(magic) != binLogMagic {
+		return fmt.Errorf("not an OoO470 binary log")
+	}
+	physRegs, err := binary.ReadUvarint(r.input)
+	if err != nil || physRegs < logicRegisters || physRegs >= 1<<15 {
+		return fmt.Errorf("malformed binary log header")
+	}
+	r.curr.PhysicalRegisterFile = make([]uint64, physRegs)
+	r.curr.BusyBitTable = make([]bool, physRegs)
+
+	out := bufio.NewWriter(output)
+	out.WriteByte('[')
+	for i := 0; ; i++ {
+		s, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if i != 0 {
+			out.WriteByte(',')
+		}
+		out.Write(data)
+	}
+	out.WriteString("]\n")
+
+	return out.Flush()
+}
@@ -0,0 +1,125 @@
+package processor
+
+// Steering is the policy assigning dispatched instructions to the clusters of the backend.
+type Steering string
+
+const (
+	// RoundRobinSteering sends consecutive instructions to consecutive clusters.
+	RoundRobinSteering Steering = "round-robin"
+	// DependenceSteering sends an instruction to the cluster of the producer of its operands,
+	// or to the least loaded cluster when they are all available.
+	DependenceSteering Steering = "dependence"
+)
+
+var AllSteerings = []Steering{RoundRobinSteering, DependenceSteering}
+
+// SetClusters splits the backend into clusters, see Config.
+func (p *Processor) SetClusters(clusters, delay int, steering Steering) error {
+	config := p.config
+	config.Clusters, config.ClusterDelay, config.Steering = clusters, delay, steering
+	if err := config.validate(); err != nil {
+		return err
+	}
+	p.config = config
+	return nil
+}
+
+// noCluster marks the registers whose value is visible in every cluster, e.g. the initial ones.
+const noCluster = -1
+
+func (c Config) clustered() bool {
+	return c.Clusters > 1
+}
+
+func (c Config) clusterOf(alu int) int {
+	return alu / (c.ALUs / c.Clusters)
+}
+
+// operandAvailable reports whether the register can be read by an instruction executing in the cluster.
+// Values produced in another cluster arrive ClusterDelay cycles after their writeback.
+func (p *Processor) operandAvailable(reg PhysReg, cluster int) bool {
+	if p.workingState.BusyBitTable[reg] {
+		return false
+	}
+	producer := p.workingState.regCluster[reg]
+	return producer == noCluster || producer == cluster || p.cycle >= p.workingState.regWrittenAt[reg]+uint64(p.config.ClusterDelay)
+}
+
+func (p *Processor) countCrossClusterRead(reg PhysReg, cluster int) {
+	producer := p.workingState.regCluster[reg]
+	if producer != noCluster && producer != cluster && !p.operandAvailable(reg, cluster) {
+		p.stats.CrossClusterReads++
+	}
+}
+
+// sourceRegs returns the logical registers read by the instruction.
+func (i instruction) sourceRegs() []LogicReg {
+	var regs []LogicReg
+	if i.opA != noLogicReg {
+		regs = append(regs, i.opA)
+	}
+	if i.type_ != addi && i.opB.reg != noLogicReg {
+		regs = append(regs, i.opB.reg)
+	}
+	return regs
+}
+
+// steer picks the cluster of every decoded instruction and the next round-robin cluster, it reports
+// false when one of them finds its slice of the integer queue full. The reserved entries of every cluster
+// count as used.
+func (p *Processor) steer(reserved []int) (clusters []int, next int, ok bool) {
+	sliceSize := p.config.IntegerQueueSize / p.config.Clusters
+
+	load := append([]int(nil), reserved...)
+	for _, iqe := range p.workingState.IntegerQueue {
+		load[iqe.cluster]++
+	}
+	leastLoaded := func() int {
+		best := 0
+		for c := range load {
+			if load[c] < load[best] {
+				best = c
+			}
+		}
+		return best
+	}
+
+	next = p.nextCluster
+	// Clusters of the destinations renamed by the same group.
+	groupClusters := make(map[LogicReg]int)
+	for _, insPc := range p.workingState.DecodedPCs {
+		ins := p.instructions[insPc]
+
+		cluster := noCluster
+		switch p.config.Steering {
+		case RoundRobinSteering:
+			cluster = next
+			next = (next + 1) % p.config.Clusters
+		case DependenceSteering:
+			for _, r := range ins.sourceRegs() {
+				if c, ok := groupClusters[r]; ok {
+					cluster = c
+					break
+				}
+				if tag := p.workingState.RegisterMapTable[r]; p.workingState.BusyBitTable[tag] {
+					cluster = p.workingState.regCluster[tag]
+					break
+				}
+			}
+			if cluster == noCluster || load[cluster]+1 >= sliceSize {
+				cluster = leastLoaded()
+			}
+		}
+
+		if load[cluster]+1 >= sliceSize {
+			return nil, next, false
+		}
+		load[cluster]++
+		if ins.dest != noLogicReg {
+			groupClusters[ins.dest] = cluster
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, next, true
+}
@@ -0,0 +1,72 @@
+package processor
+
+import "fmt"
+
+const (
+	logicRegisters = 32
+	fetchWidth     = 4
+)
+
+// Config holds the sizes of the structures of the R10000-style core.
+type Config struct {
+	ActiveListSize   int
+	IntegerQueueSize int
+	ALUs             int
+	// FreeListSize is the number of physical registers on top of the 32 architectural ones.
+	FreeListSize int
+	// EarlyRelease frees the previous mapping of a destination once it has no pending readers, instead of at commit.
+	EarlyRelease bool
+	// SpeculativeWakeup wakes consumers when their producer enters the second ALU stage, assuming it completes
+	// in the next cycle. Consumers of a producer that takes longer are replayed.
+	SpeculativeWakeup bool
+	// LoadMissLatency is the number of extra cycles of the traced loads that miss in the data cache.
+	LoadMissLatency int
+	// Clusters splits the integer queue and the ALUs into equal slices, each instruction is steered to one.
+	Clusters int
+	// ClusterDelay is the number of extra cycles for a value to reach the other clusters.
+	ClusterDelay int
+	Steering     Steering
+}
+
+// DefaultConfig is the configuration of the CS470 OoO470 processor.
+func DefaultConfig() Config {
+	return Config{
+		ActiveListSize:   32,
+		IntegerQueueSize: 32,
+		ALUs:             4,
+		FreeListSize:     32,
+		Clusters:         1,
+		Steering:         DependenceSteering,
+	}
+}
+
+func (c Config) physicalRegisters() int {
+	return logicRegisters + c.FreeListSize
+}
+
+func (c Config) validate() error {
+	// Four instructions are dispatched at once, smaller structures would never accept them.
+	if c.ActiveListSize <= fetchWidth || c.IntegerQueueSize <= fetchWidth || c.ALUs < 1 || c.FreeListSize < fetchWidth || c.LoadMissLatency < 0 {
+		return fmt.Errorf("invalid config: %+v", c)
+	}
+	if c.Clusters < 1 || c.ClusterDelay < 0 {
+		return fmt.Errorf("invalid config: %+v", c)
+	}
+	if c.clustered() {
+		// Every cluster must accept a whole group, like the monolithic integer queue.
+		if c.ALUs%c.Clusters != 0 || c.IntegerQueueSize/c.Clusters <= fetchWidth {
+			return fmt.Errorf("invalid config, cannot split into %d clusters: %+v", c.Clusters, c)
+		}
+		valid := false
+		for _, s := range AllSteerings {
+			valid = valid || c.Steering == s
+		}
+		if !valid {
+			return fmt.Errorf("unknown steering policy: %s", c.Steering)
+		}
+	}
+	if c.physicalRegisters() >= 1<<15 {
+		return fmt.Errorf("invalid config, too many physical registers: %d", c.physicalRegisters())
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+)
+
+// Core is a cycle-level processor model that runs CS470 programs.
+type Core interface {
+	// Load parses the program and resets the core to its initial state.
+	Load(program []string) error
+	// ScheduleInterrupt raises an external interrupt in the given cycle.
+	ScheduleInterrupt(cycle uint64)
+	// Step simulates a single cycle, it reports whether the simulation has finished.
+	Step() (done bool)
+	// WriteLog writes the state of every simulated cycle in the core's JSON schema.
+	WriteLog(output io.Writer) error
+	// Stats returns the performance counters of the simulation so far.
+	Stats() Stats
+}
+
+// Models lists the names of the core models accepted by NewCore.
+var Models = []string{"r10k", "tomasulo", "inorder"}
+
+// NewCore creates the core model with the given name.
+func NewCore(model string) (Core, error) {
+	switch model {
+	case "r10k":
+		return New(), nil
+	case "tomasulo":
+		return NewTomasulo(), nil
+	case "inorder":
+		return NewInOrder(), nil
+	default:
+		return nil, fmt.Errorf("unknown core model: %s", model)
+	}
+}
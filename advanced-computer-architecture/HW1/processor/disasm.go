@@ -0,0 +1,81 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (r LogicReg) String() string {
+	return fmt.Sprintf("x%d", r)
+}
+
+func (i instruction) String() string {
+	if i.trace != nil {
+		return i.traceString()
+	}
+	if i.type_ == addi {
+		return fmt.Sprintf("%s %s, %s, %d", i.type_, i.dest, i.opA, i.opB.imm)
+	}
+	return fmt.Sprintf("%s %s, %s, %s", i.type_, i.dest, i.opA, i.opB.reg)
+}
+
+// traceString disassembles a traced instruction, leaving out its absent operands.
+func (i instruction) traceString() string {
+	var operands []string
+	for _, r := range []LogicReg{i.dest, i.opA, i.opB.reg} {
+		if r != noLogicReg {
+			operands = append(operands, r.String())
+		}
+	}
+	if i.trace.Imm != nil {
+		operands = append(operands, fmt.Sprint(*i.trace.Imm))
+	}
+	s := fmt.Sprintf("%s %s", i.type_, strings.Join(operands, ", "))
+	if i.trace.Addr != nil {
+		s += fmt.Sprintf(" [0x%x]", *i.trace.Addr)
+	}
+	return fmt.Sprintf("%s @ 0x%x", strings.TrimSpace(s), i.trace.PC)
+}
+
+// encode returns the RV64IM machine code of the instruction, immediates are truncated to 12 bits.
+// Traced instructions may use any opcode and are encoded as 0.
+func (i instruction) encode() uint32 {
+	if i.trace != nil {
+		return 0
+	}
+	const (
+		opImm = 0b0010011
+		op    = 0b0110011
+	)
+	rd, rs1 := uint32(i.dest), uint32(i.opA)
+
+	if i.type_ == addi {
+		imm := uint32(i.opB.imm) & 0xfff
+		return imm<<20 | rs1<<15 | rd<<7 | opImm
+	}
+
+	var funct7, funct3 uint32
+	switch i.type_ {
+	case add:
+	case sub:
+		funct7 = 0b0100000
+	case mulu:
+		funct7 = 0b0000001
+	case divu:
+		funct7, funct3 = 0b0000001, 0b101
+	case remu:
+		funct7, funct3 = 0b0000001, 0b111
+	default:
+		panic("unexpected instruction type: " + string(i.type_))
+	}
+	rs2 := uint32(i.opB.reg)
+	return funct7<<25 | rs2<<20 | rs1<<15 | funct3<<12 | rd<<7 | op
+}
+
+// Disassemble returns the assembly of the instruction at the given PC.
+func (p *Processor) Disassemble(pc uint64) string {
+	if pc >= uint64(len(p.instructions)) {
+		return "<invalid>"
+	}
+	return p.instructions[pc].String()
+}
@@ -0,0 +1,281 @@
+package processor
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+)
+
+// FaultTarget is the structure a fault is injected into.
+type FaultTarget string
+
+const (
+	PhysicalRegisterFileFault FaultTarget = "prf"
+	RegisterMapTableFault     FaultTarget = "rmt"
+	IntegerQueueFault         FaultTarget = "iq"
+	ActiveListFault           FaultTarget = "al"
+)
+
+var AllFaultTargets = []FaultTarget{PhysicalRegisterFileFault, RegisterMapTableFault, IntegerQueueFault, ActiveListFault}
+
+// Fields of the integer queue entries that can be hit.
+const (
+	OpAValueField = iota
+	OpBValueField
+	integerQueueFields
+)
+
+// Fields of the active list entries that can be hit.
+const (
+	DoneField = iota
+	ExceptionField
+	LogicalDestinationField
+	OldDestinationField
+	PCField
+	activeListFields
+)
+
+// Random marks a fault coordinate to be chosen at random when the fault is injected.
+const Random = -1
+
+// Fault is a single bit flip, applied at the end of Cycle.
+type Fault struct {
+	Target FaultTarget
+	Cycle  uint64
+	// Index of the register or of the queue entry.
+	Index int
+	// Field of the queue entry, unused for registers.
+	Field int
+	Bit   int
+}
+
+func (f Fault) String() string {
+	return fmt.Sprintf("%s[%d].%d bit %d at cycle %d", f.Target, f.Index, f.Field, f.Bit, f.Cycle)
+}
+
+type pendingFault struct {
+	fault Fault
+	rng   *rand.Rand
+}
+
+// InjectFault schedules the fault, its Random coordinates are drawn from rng when it is applied.
+func (p *Processor) InjectFault(f Fault, rng *rand.Rand) {
+	p.faults = append(p.faults, pendingFault{fault: f, rng: rng})
+}
+
+// AppliedFaults returns the faults injected so far with their coordinates resolved.
+// The entries of the queues are drawn over their whole size, faults that hit an empty one are not applied.
+func (p *Processor) AppliedFaults() []Fault {
+	return p.appliedFaults
+}
+
+func (p *Processor) applyFaults() {
+	for _, pf := range p.faults {
+		if pf.fault.Cycle != p.cycle {
+			continue
+		}
+		if f, ok := p.applyFault(pf.fault, pf.rng); ok {
+			p.appliedFaults = append(p.appliedFaults, f)
+		}
+	}
+}
+
+func pick(rng *rand.Rand, value, n int) int {
+	if value == Random {
+		return rng.Intn(n)
+	}
+	return value
+}
+
+// faultShape returns the number of entries of the structure, of fields of an entry, and of bits of the field of
+// the entries. The width is 0 for a Random field of the active list, whose fields differ in width.
+func (p *Processor) faultShape(target FaultTarget, field int) (entries, fields, width int) {
+	physBits := bits.Len(uint(p.config.physicalRegisters() - 1))
+	switch target {
+	case PhysicalRegisterFileFault:
+		return p.config.physicalRegisters(), 1, 64
+	case RegisterMapTableFault:
+		return logicRegisters, 1, physBits
+	case IntegerQueueFault:
+		return p.config.IntegerQueueSize, integerQueueFields, 64
+	case ActiveListFault:
+		switch field {
+		case DoneField, ExceptionField:
+			width = 1
+		case LogicalDestinationField:
+			width = 5
+		case OldDestinationField:
+			width = physBits
+		case PCField:
+			width = bits.Len(uint(len(p.instructions)))
+		}
+		return p.config.ActiveListSize, activeListFields, width
+	default:
+		panic("unexpected fault target: " + string(target))
+	}
+}
+
+// CheckFault reports the coordinates of the fault outside of the structure it targets in the loaded program, the
+// Random ones are always valid and the field is ignored for the registers.
+func (p *Processor) CheckFault(f Fault) error {
+	valid := false
+	for _, t := range AllFaultTargets {
+		valid = valid || f.Target == t
+	}
+	if !valid {
+		return fmt.Errorf("unknown fault target: %s", f.Target)
+	}
+
+	entries, fields, width := p.faultShape(f.Target, f.Field)
+	switch {
+	case f.Index != Random && (f.Index < 0 || f.Index >= entries):
+		return fmt.Errorf("invalid fault, %s has %d entries: %d", f.Target, entries, f.Index)
+	case f.Field != Random && fields > 1 && (f.Field < 0 || f.Field >= fields):
+		return fmt.Errorf("invalid fault, %s entries have %d fields: %d", f.Target, fields, f.Field)
+	case f.Bit != Random && width == 0:
+		return fmt.Errorf("invalid fault, the bit of a %s fault needs its field", f.Target)
+	case f.Bit != Random && (f.Bit < 0 || f.Bit >= width):
+		return fmt.Errorf("invalid fault, %s field %d has %d bits: %d", f.Target, f.Field, width, f.Bit)
+	}
+	return nil
+}
+
+func (p *Processor) applyFault(f Fault, rng *rand.Rand) (Fault, bool) {
+	s := &p.state
+
+	switch f.Target {
+	case PhysicalRegisterFileFault:
+		f.Index = pick(rng, f.Index, len(s.PhysicalRegisterFile))
+		f.Bit = pick(rng, f.Bit, 64)
+		s.PhysicalRegisterFile[f.Index] ^= 1 << f.Bit
+	case RegisterMapTableFault:
+		f.Index = pick(rng, f.Index, len(s.RegisterMapTable))
+		_, _, width := p.faultShape(f.Target, f.Field)
+		f.Bit = pick(rng, f.Bit, width)
+		s.RegisterMapTable[f.Index] ^= 1 << f.Bit
+	case IntegerQueueFault:
+		f.Index = pick(rng, f.Index, p.config.IntegerQueueSize)
+		f.Field = pick(rng, f.Field, integerQueueFields)
+		f.Bit = pick(rng, f.Bit, 64)
+		if f.Index >= len(s.IntegerQueue) {
+			return f, false
+		}
+		iqe := &s.IntegerQueue[f.Index]
+		if f.Field == OpAValueField {
+			iqe.OpAValue ^= 1 << f.Bit
+		} else {
+			iqe.OpBValue ^= 1 << f.Bit
+		}
+	case ActiveListFault:
+		f.Index = pick(rng, f.Index, p.config.ActiveListSize)
+		f.Field = pick(rng, f.Field, activeListFields)
+		_, _, width := p.faultShape(f.Target, f.Field)
+		f.Bit = pick(rng, f.Bit, width)
+		if f.Index >= len(s.ActiveList) {
+			return f, false
+		}
+		ale := &s.ActiveList[f.Index]
+		switch f.Field {
+		case DoneField:
+			ale.Done = !ale.Done
+		case ExceptionField:
+			ale.Exception = !ale.Exception
+		case LogicalDestinationField:
+			ale.LogicalDestination ^= 1 << f.Bit
+		case OldDestinationField:
+			ale.OldDestination ^= 1 << f.Bit
+		case PCField:
+			ale.PC ^= 1 << f.Bit
+		}
+	default:
+		panic("unexpected fault target: " + string(f.Target))
+	}
+	return f, true
+}
+
+// ArchitecturalRegisters returns the values of the logical registers as seen through the register map table.
+func (p *Processor) ArchitecturalRegisters() [logicRegisters]uint64 {
+	var regs [logicRegisters]uint64
+	for i, phys := range p.state.RegisterMapTable {
+		regs[i] = p.state.PhysicalRegisterFile[phys]
+	}
+	return regs
+}
+
+// FaultOutcome classifies the effect of a fault on the program.
+type FaultOutcome string
+
+const (
+	Masked               FaultOutcome = "masked"
+	SilentDataCorruption FaultOutcome = "sdc"
+	ExceptionOutcome     FaultOutcome = "exception"
+	Hang                 FaultOutcome = "hang"
+)
+
+var AllFaultOutcomes = []FaultOutcome{Masked, SilentDataCorruption, ExceptionOutcome, Hang}
+
+// RunResult is the architectural outcome of a simulation.
+type RunResult struct {
+	Cycles      uint64
+	Registers   [logicRegisters]uint64
+	Exception   bool
+	ExceptionPC uint64
+	// Crashed is set when the corrupted state made the model itself fail, e.g. by indexing out of range.
+	Crashed bool
+	// TimedOut is set when the program did not finish in the allowed number of cycles.
+	TimedOut bool
+}
+
+// Run simulates the loaded program for at most maxCycles cycles, a fault that corrupts the model counts as a crash.
+func (p *Processor) Run(maxCycles uint64) (res RunResult) {
+	exception := false
+	exceptionPC := uint64(0)
+	p.AddObserver(exceptionRecorder{exception: &exception, exceptionPC: &exceptionPC})
+
+	defer func() {
+		if r := recover(); r != nil {
+			res.Crashed = true
+		}
+	}()
+
+	for !p.Step() {
+		if p.cycle >= maxCycles {
+			res.TimedOut = true
+			break
+		}
+	}
+
+	res.Cycles = p.cycle
+	res.Registers = p.ArchitecturalRegisters()
+	res.Exception = exception
+	res.ExceptionPC = exceptionPC
+	return res
+}
+
+type exceptionRecorder struct {
+	BaseObserver
+	exception   *bool
+	exceptionPC *uint64
+}
+
+func (e exceptionRecorder) OnException(_ uint64, pc uint64) {
+	*e.exception, *e.exceptionPC = true, pc
+}
+
+func (e exceptionRecorder) OnInterrupt(_ uint64, pc uint64, _ uint64) {
+	*e.exception, *e.exceptionPC = true, pc
+}
+
+// Classify compares a faulty run against the fault-free one.
+func Classify(golden, faulty RunResult) FaultOutcome {
+	switch {
+	case faulty.TimedOut:
+		return Hang
+	case faulty.Crashed || faulty.Exception != golden.Exception || faulty.ExceptionPC != golden.ExceptionPC:
+		return ExceptionOutcome
+	case faulty.Registers != golden.Registers:
+		return SilentDataCorruption
+	default:
+		return Masked
+	}
+}
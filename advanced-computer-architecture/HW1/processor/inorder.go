@@ -0,0 +1,290 @@
+package processor
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// InFlightInstruction is an instruction in one of the execution stages of the in-order pipeline.
+type InFlightInstruction struct {
+	OpCode   string
+	Dest     LogicReg
+	OpAValue uint64
+	OpBValue uint64
+	PC       uint64
+}
+
+type inOrderALU struct {
+	assigned   *InFlightInstruction
+	inProgress *InFlightInstruction
+	done       *InFlightInstruction
+}
+
+func (a *inOrderALU) progress() {
+	a.done = a.inProgress
+	a.inProgress = a.assigned
+	a.assigned = nil
+}
+
+type inOrderState struct {
+	PC           uint64
+	DecodedPCs   []uint64
+	ExceptionPC  uint64
+	Exception    bool
+	RegisterFile [32]uint64
+	// Scoreboard marks the registers with a write still in flight.
+	Scoreboard [32]bool
+	// Executing lists the in-flight instructions, the oldest first.
+	Executing []InFlightInstruction
+
+	alu [4]inOrderALU
+}
+
+func (s *inOrderState) copy() inOrderState {
+	copied := *s
+
+	copied.DecodedPCs = append(make([]uint64, 0, len(s.DecodedPCs)), s.DecodedPCs...)
+	copied.Executing = nil
+
+	return copied
+}
+
+// InOrder is a multi-issue in-order pipeline with a scoreboard, it is the baseline the out-of-order cores are compared to.
+// Instructions issue in program order until the first one with a RAW or WAW hazard or without a free ALU.
+type InOrder struct {
+	state        inOrderState
+	workingState inOrderState
+	instructions []instruction
+	log          []inOrderState
+	end          bool
+	cycle        uint64
+	interrupts   []uint64
+	stats        Stats
+}
+
+func NewInOrder() *InOrder {
+	var proc InOrder
+
+	proc.reset()
+
+	return &proc
+}
+
+func (p *InOrder) reset() {
+	*p = InOrder{}
+}
+
+func (p *InOrder) Load(program []string) (err error) {
+	p.reset()
+
+	var interrupts []uint64
+	p.instructions, interrupts, err = parseProgram(program)
+	if err != nil {
+		return err
+	}
+	for _, cycle := range interrupts {
+		p.ScheduleInterrupt(cycle)
+	}
+
+	p.dumpStateIntoLog()
+
+	return nil
+}
+
+func (p *InOrder) ScheduleInterrupt(cycle uint64) {
+	p.interrupts = append(p.interrupts, cycle)
+	sort.Slice(p.interrupts, func(i, j int) bool { return p.interrupts[i] < p.interrupts[j] })
+}
+
+func (s *inOrderState) inFlight() []*InFlightInstruction {
+	var res []*InFlightInstruction
+	for _, a := range s.alu {
+		for _, ins := range []*InFlightInstruction{a.done, a.inProgress, a.assigned} {
+			if ins != nil {
+				res = append(res, ins)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].PC < res[j].PC })
+	return res
+}
+
+func (p *InOrder) finished() bool {
+	if p.end {
+		return true
+	}
+	for _, a := range p.state.alu {
+		if a.assigned != nil || a.inProgress != nil || a.done != nil {
+			return false
+		}
+	}
+	return !(p.state.Exception || p.state.PC < uint64(len(p.instructions)) || len(p.state.DecodedPCs) != 0)
+}
+
+func (p *InOrder) Step() (done bool) {
+	if p.finished() {
+		return true
+	}
+
+	p.cycle++
+
+	p.propagate()
+
+	p.state = p.workingState
+
+	p.dumpStateIntoLog()
+
+	return p.finished()
+}
+
+func (p *InOrder) WriteLog(output io.Writer) error {
+	return json.NewEncoder(output).Encode(p.log)
+}
+
+func (p *InOrder) Stats() Stats {
+	stats := p.stats
+	stats.Cycles = p.cycle
+	return stats
+}
+
+func (p *InOrder) dumpStateIntoLog() {
+	s := p.state.copy()
+	if s.DecodedPCs == nil {
+		s.DecodedPCs = make([]uint64, 0)
+	}
+	s.Executing = make([]InFlightInstruction, 0)
+	for _, ins := range p.state.inFlight() {
+		s.Executing = append(s.Executing, *ins)
+	}
+	p.log = append(p.log, s)
+}
+
+func (p *InOrder) propagate() {
+	p.workingState = p.state.copy()
+
+	if p.workingState.Exception {
+		p.workingState.Exception = false
+		p.end = true
+		return
+	}
+
+	p.writeBack()
+	p.issue()
+	p.fetchAndDecode()
+}
+
+// writeBack retires the instructions leaving the ALUs, in program order.
+func (p *InOrder) writeBack() {
+	for i := range p.workingState.alu {
+		p.workingState.alu[i].progress()
+	}
+
+	var done []*InFlightInstruction
+	for i := range p.workingState.alu {
+		a := &p.workingState.alu[i]
+		if a.done != nil {
+			done = append(done, a.done)
+			a.done = nil
+		}
+	}
+	sort.Slice(done, func(i, j int) bool { return done[i].PC < done[j].PC })
+
+	for _, ins := range done {
+		res, exc := compute(ins.OpCode, ins.OpAValue, ins.OpBValue)
+		if exc {
+			p.raiseException(ins.PC)
+			return
+		}
+		p.workingState.RegisterFile[ins.Dest] = res
+		p.workingState.Scoreboard[ins.Dest] = false
+		p.stats.Committed++
+	}
+
+	if len(p.interrupts) != 0 && p.interrupts[0] <= p.cycle {
+		p.interrupts = p.interrupts[1:]
+		p.raiseException(p.oldestUnretiredPC())
+	}
+}
+
+// oldestUnretiredPC is the PC of the oldest instruction that has not written its result yet.
+func (p *InOrder) oldestUnretiredPC() uint64 {
+	if inFlight := p.workingState.inFlight(); len(inFlight) != 0 {
+		return inFlight[0].PC
+	}
+	if len(p.workingState.DecodedPCs) != 0 {
+		return p.workingState.DecodedPCs[0]
+	}
+	return p.workingState.PC
+}
+
+func (p *InOrder) raiseException(pc uint64) {
+	p.workingState.Exception = true
+	p.workingState.ExceptionPC = pc
+	p.workingState.Scoreboard = [32]bool{}
+	p.workingState.alu = [4]inOrderALU{}
+	p.workingState.DecodedPCs = nil
+	p.workingState.PC = 0x10000
+}
+
+func (p *InOrder) issue() {
+	if p.workingState.Exception {
+		return
+	}
+
+	issued := 0
+	for _, pc := range p.workingState.DecodedPCs {
+		ins := p.instructions[pc]
+
+		hazard := p.workingState.Scoreboard[ins.opA] || p.workingState.Scoreboard[ins.dest] ||
+			(ins.type_ != addi && p.workingState.Scoreboard[ins.opB.reg])
+		if hazard {
+			break
+		}
+
+		a := p.freeALU()
+		if a == nil {
+			break
+		}
+
+		inFlight := &InFlightInstruction{
+			OpCode:   ins.type_.toOpCode(),
+			Dest:     ins.dest,
+			OpAValue: p.workingState.RegisterFile[ins.opA],
+			PC:       pc,
+		}
+		if ins.type_ == addi {
+			inFlight.OpBValue = i64Tou64(ins.opB.imm)
+		} else {
+			inFlight.OpBValue = p.workingState.RegisterFile[ins.opB.reg]
+		}
+		a.assigned = inFlight
+		p.workingState.Scoreboard[ins.dest] = true
+		issued++
+	}
+
+	if issued == 0 && len(p.workingState.DecodedPCs) != 0 {
+		p.stats.Stalls++
+	}
+	p.workingState.DecodedPCs = p.workingState.DecodedPCs[issued:]
+}
+
+func (p *InOrder) freeALU() *inOrderALU {
+	for i := range p.workingState.alu {
+		if p.workingState.alu[i].assigned == nil {
+			return &p.workingState.alu[i]
+		}
+	}
+	return nil
+}
+
+func (p *InOrder) fetchAndDecode() {
+	if p.workingState.Exception {
+		return
+	}
+
+	for len(p.workingState.DecodedPCs) < 4 && p.workingState.PC < uint64(len(p.instructions)) {
+		p.workingState.DecodedPCs = append(p.workingState.DecodedPCs, p.workingState.PC)
+		p.workingState.PC++
+	}
+}
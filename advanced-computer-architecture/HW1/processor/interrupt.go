@@ -0,0 +1,63 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const interruptDirective = "interrupt at cycle"
+
+// parseInterrupt recognises the "interrupt at cycle N" directive of the input program.
+func parseInterrupt(line string) (cycle uint64, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "interrupt" {
+		return 0, false, nil
+	}
+	if len(fields) != 4 || strings.Join(fields[:3], " ") != interruptDirective {
+		return 0, true, fmt.Errorf("malformed directive: %s", line)
+	}
+	cycle, err = strconv.ParseUint(fields[3], 0, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("malformed directive: %s", line)
+	}
+	return cycle, true, nil
+}
+
+// ScheduleInterrupt raises an external interrupt in the given cycle.
+// It is taken at the first commit boundary at or after that cycle.
+func (p *Processor) ScheduleInterrupt(cycle uint64) {
+	p.interrupts = append(p.interrupts, cycle)
+	sort.Slice(p.interrupts, func(i, j int) bool { return p.interrupts[i] < p.interrupts[j] })
+}
+
+// InterruptsScheduled reports whether interrupts are still to be taken, from the program or ScheduleInterrupt.
+func (p *Processor) InterruptsScheduled() bool {
+	return len(p.interrupts) != 0
+}
+
+func (p *Processor) interruptPending() bool {
+	return len(p.interrupts) != 0 && p.interrupts[0] <= p.cycle
+}
+
+// oldestUncommittedPC is the PC at which execution resumes after an interrupt.
+func (p *Processor) oldestUncommittedPC() uint64 {
+	if len(p.workingState.ActiveList) != 0 {
+		return p.workingState.ActiveList[0].PC
+	}
+	if len(p.workingState.DecodedPCs) != 0 {
+		return p.workingState.DecodedPCs[0]
+	}
+	return p.workingState.PC
+}
+
+func (p *Processor) takeInterrupt() {
+	raisedAt := p.interrupts[0]
+	p.interrupts = p.interrupts[1:]
+
+	pc := p.oldestUncommittedPC()
+	p.workingState.Exception = true
+	p.workingState.ExceptionPC = pc
+	p.notify(func(o Observer) { o.OnInterrupt(p.cycle, pc, raisedAt) })
+}
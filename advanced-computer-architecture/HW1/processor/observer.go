@@ -0,0 +1,41 @@
+package processor
+
+// Observer receives pipeline events while the processor is stepped.
+// Every hook gets the number of the cycle in which the event happened.
+type Observer interface {
+	// OnDispatch is called when an instruction enters the integer queue.
+	OnDispatch(cycle uint64, entry IntegerQueueEntry)
+	// OnIssue is called when an instruction leaves the integer queue for an ALU.
+	OnIssue(cycle uint64, alu int, entry IntegerQueueEntry)
+	// OnComplete is called when an ALU finishes executing an instruction.
+	OnComplete(cycle uint64, entry IntegerQueueEntry, exception bool)
+	// OnCommit is called when an instruction retires, value is the value written to its destination.
+	OnCommit(cycle uint64, entry ActiveListEntry, value uint64)
+	// OnException is called when an exception is detected at the head of the active list.
+	OnException(cycle uint64, pc uint64)
+	// OnInterrupt is called when an interrupt raised in cycle raisedAt is taken before the instruction at pc.
+	OnInterrupt(cycle uint64, pc uint64, raisedAt uint64)
+	// OnCycleEnd is called with the state latched at the end of every cycle, including the initial one.
+	OnCycleEnd(state State)
+}
+
+// BaseObserver implements Observer with no-op hooks, embed it to override only the needed ones.
+type BaseObserver struct{}
+
+func (BaseObserver) OnDispatch(uint64, IntegerQueueEntry)       {}
+func (BaseObserver) OnIssue(uint64, int, IntegerQueueEntry)     {}
+func (BaseObserver) OnComplete(uint64, IntegerQueueEntry, bool) {}
+func (BaseObserver) OnCommit(uint64, ActiveListEntry, uint64)   {}
+func (BaseObserver) OnException(uint64, uint64)                 {}
+func (BaseObserver) OnInterrupt(uint64, uint64, uint64)         {}
+func (BaseObserver) OnCycleEnd(State)                           {}
+
+func (p *Processor) AddObserver(o Observer) {
+	p.observers = append(p.observers, o)
+}
+
+func (p *Processor) notify(f func(o Observer)) {
+	for _, o := range p.observers {
+		f(o)
+	}
+}
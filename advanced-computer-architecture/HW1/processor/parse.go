@@ -71,3 +71,26 @@ func parseInstruction(asm string) (ins instruction, err error) {
 
 	return ins, nil
 }
+
+// parseProgram splits the input program into instructions and interrupt directives.
+func parseProgram(program []string) (instructions []instruction, interrupts []uint64, err error) {
+	instructions = make([]instruction, 0, len(program))
+	for _, line := range program {
+		cycle, isInterrupt, err := parseInterrupt(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isInterrupt {
+			interrupts = append(interrupts, cycle)
+			continue
+		}
+
+		ins, err := parseInstruction(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		instructions = append(instructions, ins)
+	}
+
+	return instructions, interrupts, nil
+}
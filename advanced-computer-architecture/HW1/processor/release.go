@@ -0,0 +1,64 @@
+package processor
+
+// SetEarlyRelease enables or disables the early release of physical registers.
+func (p *Processor) SetEarlyRelease(enabled bool) {
+	p.config.EarlyRelease = enabled
+}
+
+func (e *IntegerQueueEntry) reads(reg PhysReg) bool {
+	return ((!e.OpAIsReady || e.opASpeculative) && e.OpARegTag == reg) || ((!e.OpBIsReady || e.opBSpeculative) && e.OpBRegTag == reg)
+}
+
+// hasPendingReaders reports whether an instruction still has to read the register. Issued instructions
+// have read their operands already unless they were woken speculatively, younger ones read the new mapping.
+func (s *state) hasPendingReaders(reg PhysReg) bool {
+	for i := range s.IntegerQueue {
+		if s.IntegerQueue[i].reads(reg) {
+			return true
+		}
+	}
+	for _, a := range s.alu {
+		for _, e := range []*IntegerQueueEntry{a.assigned, a.inProgress} {
+			if e != nil && e.reads(reg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// releaseEarly frees the previous mapping of in-flight destinations without waiting for their commit.
+// The register must hold a committed value that no instruction waits for. Its value is kept in the
+// active list entry so that recover can restore it if the overwriting instruction is rolled back.
+func (p *Processor) releaseEarly() {
+	if !p.config.EarlyRelease || p.workingState.Exception {
+		return
+	}
+
+	for i := range p.workingState.ActiveList {
+		ale := &p.workingState.ActiveList[i]
+		if ale.released || ale.OldDestination == noPhysReg {
+			continue
+		}
+
+		reg := ale.OldDestination
+		if p.workingState.BusyBitTable[reg] || p.workingState.hasPendingReaders(reg) {
+			continue
+		}
+		committed := true
+		for _, older := range p.workingState.ActiveList[:i] {
+			if older.dest == reg {
+				committed = false
+				break
+			}
+		}
+		if !committed {
+			continue
+		}
+
+		ale.released = true
+		ale.releasedValue = p.workingState.PhysicalRegisterFile[reg]
+		p.workingState.FreeList = append(p.workingState.FreeList, reg)
+		p.stats.EarlyReleases++
+	}
+}
@@ -8,7 +8,7 @@ import (
 type InstructionType string
 
 type LogicReg int8
-type PhysReg int8
+type PhysReg int16
 
 const (
 	add  InstructionType = "add"
@@ -36,17 +36,24 @@ type instruction struct {
 		reg LogicReg
 		imm int64
 	}
+	// trace is the recorded entry of instructions replayed from a trace.
+	trace *TraceEntry
 }
 
-type activeListEntry struct {
+type ActiveListEntry struct {
 	Done               bool
 	Exception          bool
 	LogicalDestination LogicReg
 	OldDestination     PhysReg
 	PC                 uint64
+
+	dest PhysReg
+	// OldDestination was freed before the commit, releasedValue is the value it held.
+	released      bool
+	releasedValue uint64
 }
 
-type integerQueueEntry struct {
+type IntegerQueueEntry struct {
 	DestRegister PhysReg
 	OpAIsReady   bool
 	OpARegTag    PhysReg
@@ -56,9 +63,16 @@ type integerQueueEntry struct {
 	OpBValue     uint64
 	OpCode       string
 	PC           uint64
+
+	recorded *uint64
+	// The operand was woken speculatively, its value is read when entering the second ALU stage.
+	opASpeculative bool
+	opBSpeculative bool
+	// cluster executing the instruction in a clustered backend.
+	cluster int
 }
 
-func (e integerQueueEntry) ready() bool {
+func (e IntegerQueueEntry) ready() bool {
 	return e.OpAIsReady && e.OpBIsReady
 }
 
@@ -74,13 +88,13 @@ func (f *freeList) get(n int) []PhysReg {
 	return res
 }
 
-type activeList []activeListEntry
+type activeList []ActiveListEntry
 
-func (a *activeList) hasEnoughFreeEntries(n int) bool {
-	return len(*a)+n < 32
+func (a *activeList) hasEnoughFreeEntries(n int, size int) bool {
+	return len(*a)+n < size
 }
 
-func (a *activeList) getEntryByPC(pc uint64) *activeListEntry {
+func (a *activeList) getEntryByPC(pc uint64) *ActiveListEntry {
 	for i := range *a {
 		ale := &(*a)[i]
 		if ale.PC == pc {
@@ -94,7 +108,7 @@ func (a *activeList) headDone() bool {
 	return len(*a) != 0 && (*a)[0].Done
 }
 
-func (a *activeList) top() activeListEntry {
+func (a *activeList) top() ActiveListEntry {
 	return (*a)[0]
 }
 
@@ -102,65 +116,84 @@ func (a *activeList) pop() {
 	*a = (*a)[1:]
 }
 
-type integerQueue []integerQueueEntry
+type integerQueue []IntegerQueueEntry
 
-func (i *integerQueue) hasEnoughFreeEntries(n int) bool {
-	return len(*i)+n < 32
+func (i *integerQueue) hasEnoughFreeEntries(n int, size int) bool {
+	return len(*i)+n < size
 }
 
-func (i *integerQueue) take(pos int) *integerQueueEntry {
+func (i *integerQueue) take(pos int) *IntegerQueueEntry {
 	res := (*i)[pos]
 	*i = append((*i)[:pos], (*i)[pos+1:]...)
 	return &res
 }
 
 type alu struct {
-	assigned   *integerQueueEntry
-	inProgress *integerQueueEntry
-	done       *integerQueueEntry
+	assigned   *IntegerQueueEntry
+	inProgress *IntegerQueueEntry
+	done       *IntegerQueueEntry
+	// stall is the number of extra cycles the second stage still needs, held is set while it waits.
+	stall int
+	held  bool
 }
 
-func (a *alu) ready() *integerQueueEntry {
+func (a *alu) ready() *IntegerQueueEntry {
 	return a.done
 }
 
 func (a *alu) result() (uint64, bool) {
-	switch a.done.OpCode {
+	if a.done.recorded != nil {
+		return *a.done.recorded, false
+	}
+	return compute(a.done.OpCode, a.done.OpAValue, a.done.OpBValue)
+}
+
+// compute returns the result of the opCode and whether it raised an exception.
+func compute(opCode string, opA, opB uint64) (uint64, bool) {
+	switch opCode {
 	case add.toOpCode(), addi.toOpCode():
-		return i64Tou64(u64Toi64(a.done.OpAValue) + u64Toi64(a.done.OpBValue)), false
+		return i64Tou64(u64Toi64(opA) + u64Toi64(opB)), false
 	case sub.toOpCode():
-		return i64Tou64(u64Toi64(a.done.OpAValue) - u64Toi64(a.done.OpBValue)), false
+		return i64Tou64(u64Toi64(opA) - u64Toi64(opB)), false
 	case mulu.toOpCode():
-		return a.done.OpAValue * a.done.OpBValue, false
+		return opA * opB, false
 	case divu.toOpCode():
-		if a.done.OpBValue == 0 {
+		if opB == 0 {
 			return 0, true
 		}
-		return a.done.OpAValue / a.done.OpBValue, false
+		return opA / opB, false
 	case remu.toOpCode():
-		if a.done.OpBValue == 0 {
+		if opB == 0 {
 			return 0, true
 		}
-		return a.done.OpAValue % a.done.OpBValue, false
+		return opA % opB, false
 	default:
-		panic("unexpected opCode: " + a.done.OpCode)
+		panic("unexpected opCode: " + opCode)
 	}
 }
 
 func (a *alu) progress() {
+	if a.stall > 0 {
+		// A slow instruction holds the second stage and blocks the one behind it.
+		a.stall--
+		a.held = true
+		a.done = nil
+		return
+	}
+	a.held = false
 	a.done = a.inProgress
 	a.inProgress = a.assigned
 	a.assigned = nil
 }
 
-func (a *alu) assign(entry *integerQueueEntry) {
+func (a *alu) assign(entry *IntegerQueueEntry) {
 	a.assigned = entry
 }
 
 type state struct {
 	PC uint64
 
-	PhysicalRegisterFile [64]uint64
+	PhysicalRegisterFile []uint64
 
 	DecodedPCs []uint64
 
@@ -171,7 +204,7 @@ type state struct {
 
 	FreeList freeList
 
-	BusyBitTable [64]bool
+	BusyBitTable []bool
 
 	ActiveList activeList
 
@@ -179,7 +212,11 @@ type state struct {
 
 	backpressure bool
 
-	alu [4]alu
+	alu []alu
+
+	// Cluster producing every physical register and the cycle of its writeback.
+	regCluster   []int
+	regWrittenAt []uint64
 }
 
 type Processor struct {
@@ -188,6 +225,20 @@ type Processor struct {
 	instructions []instruction
 	log          []state
 	end          bool
+	cycle        uint64
+	observers    []Observer
+	interrupts   []uint64
+	stats        Stats
+	config       Config
+
+	faults        []pendingFault
+	appliedFaults []Fault
+
+	logDisabled bool
+
+	cache dataCache
+
+	nextCluster int
 }
 
 func (s *state) copy() state {
@@ -201,23 +252,39 @@ func (s *state) copy() state {
 	copy(copied.FreeList, s.FreeList)
 	copied.DecodedPCs = make([]uint64, len(s.DecodedPCs))
 	copy(copied.DecodedPCs, s.DecodedPCs)
+	copied.PhysicalRegisterFile = make([]uint64, len(s.PhysicalRegisterFile))
+	copy(copied.PhysicalRegisterFile, s.PhysicalRegisterFile)
+	copied.BusyBitTable = make([]bool, len(s.BusyBitTable))
+	copy(copied.BusyBitTable, s.BusyBitTable)
+	copied.alu = make([]alu, len(s.alu))
+	copy(copied.alu, s.alu)
+	copied.regCluster = make([]int, len(s.regCluster))
+	copy(copied.regCluster, s.regCluster)
+	copied.regWrittenAt = make([]uint64, len(s.regWrittenAt))
+	copy(copied.regWrittenAt, s.regWrittenAt)
 
 	return copied
 }
 
 func (p *Processor) parseInstructions(instructions []string) (err error) {
-	p.instructions = make([]instruction, len(instructions))
-	for i, ins := range instructions {
-		p.instructions[i], err = parseInstruction(ins)
-		if err != nil {
-			return err
-		}
+	var interrupts []uint64
+	p.instructions, interrupts, err = parseProgram(instructions)
+	for _, cycle := range interrupts {
+		p.ScheduleInterrupt(cycle)
 	}
-
-	return nil
+	return err
 }
 
 func (p *Processor) dumpStateIntoLog() {
+	if len(p.observers) != 0 {
+		snapshot := p.State()
+		p.notify(func(o Observer) { o.OnCycleEnd(snapshot) })
+	}
+
+	if p.logDisabled {
+		return
+	}
+
 	s := p.state.copy()
 	// Gotta to hate go's default json package for that.
 	if s.ActiveList == nil {
@@ -261,57 +328,108 @@ func (p *Processor) renameAndDispatch() {
 	}
 
 	numInstructions := len(p.workingState.DecodedPCs)
+	numDestinations := 0
+	for _, insPc := range p.workingState.DecodedPCs {
+		if p.instructions[insPc].dest != noLogicReg {
+			numDestinations++
+		}
+	}
+
+	// The instructions issued speculatively keep their entry until they cannot be replayed.
+	reserved := p.speculativeIssues()
+	numReserved := 0
+	for _, n := range reserved {
+		numReserved += n
+	}
+
+	activeListFull := !p.workingState.ActiveList.hasEnoughFreeEntries(numInstructions, p.config.ActiveListSize)
+	integerQueueFull := !p.workingState.IntegerQueue.hasEnoughFreeEntries(numInstructions+numReserved, p.config.IntegerQueueSize)
+	freeListEmpty := !p.workingState.FreeList.hasEnoughFreeEntries(numDestinations)
+
+	var clusters []int
+	nextCluster := p.nextCluster
+	if p.config.clustered() && !integerQueueFull {
+		var steered bool
+		clusters, nextCluster, steered = p.steer(reserved)
+		integerQueueFull = !steered
+	}
 
-	p.workingState.backpressure = !(p.workingState.ActiveList.hasEnoughFreeEntries(numInstructions) &&
-		p.workingState.IntegerQueue.hasEnoughFreeEntries(numInstructions) &&
-		p.workingState.FreeList.hasEnoughFreeEntries(numInstructions))
+	p.workingState.backpressure = activeListFull || integerQueueFull || freeListEmpty
 	if p.workingState.backpressure {
+		p.stats.countStall(activeListFull, integerQueueFull, freeListEmpty)
 		return
 	}
 
-	newDestRegs := p.workingState.FreeList.get(numInstructions)
+	p.nextCluster = nextCluster
+	newDestRegs := p.workingState.FreeList.get(numDestinations)
 	for i, insPc := range p.workingState.DecodedPCs {
 		ins := p.instructions[insPc]
 
-		iqe := integerQueueEntry{
-			DestRegister: newDestRegs[i],
+		cluster := 0
+		if clusters != nil {
+			cluster = clusters[i]
+		}
+
+		newDestReg := noPhysReg
+		if ins.dest != noLogicReg {
+			newDestReg, newDestRegs = newDestRegs[0], newDestRegs[1:]
+		}
+
+		iqe := IntegerQueueEntry{
+			DestRegister: newDestReg,
 			OpAIsReady:   false,
-			OpARegTag:    p.workingState.RegisterMapTable[ins.opA],
+			OpARegTag:    0,
 			OpAValue:     0,
 			OpBIsReady:   false,
 			OpBRegTag:    0,
 			OpBValue:     0,
 			OpCode:       ins.type_.toOpCode(),
 			PC:           insPc,
+			cluster:      cluster,
+		}
+		if ins.trace != nil {
+			iqe.recorded = ins.trace.Value
 		}
-		if !p.workingState.BusyBitTable[iqe.OpARegTag] {
+		if ins.opA == noLogicReg {
 			iqe.OpAIsReady = true
-			iqe.OpAValue = p.workingState.PhysicalRegisterFile[iqe.OpARegTag]
+		} else {
+			iqe.OpARegTag = p.workingState.RegisterMapTable[ins.opA]
+			p.countCrossClusterRead(iqe.OpARegTag, cluster)
+			if p.operandAvailable(iqe.OpARegTag, cluster) {
+				iqe.OpAIsReady = true
+				iqe.OpAValue = p.workingState.PhysicalRegisterFile[iqe.OpARegTag]
+			}
 		}
-		if ins.type_ == addi {
+		if ins.type_ == addi || ins.opB.reg == noLogicReg {
 			iqe.OpBIsReady = true
 			iqe.OpBValue = i64Tou64(ins.opB.imm)
 		} else {
 			iqe.OpBRegTag = p.workingState.RegisterMapTable[ins.opB.reg]
-			if !p.workingState.BusyBitTable[iqe.OpBRegTag] {
+			p.countCrossClusterRead(iqe.OpBRegTag, cluster)
+			if p.operandAvailable(iqe.OpBRegTag, cluster) {
 				iqe.OpBIsReady = true
 				iqe.OpBValue = p.workingState.PhysicalRegisterFile[iqe.OpBRegTag]
 			}
 		}
 
 		p.workingState.IntegerQueue = append(p.workingState.IntegerQueue, iqe)
+		p.notify(func(o Observer) { o.OnDispatch(p.cycle, iqe) })
 
-		p.workingState.ActiveList = append(p.workingState.ActiveList, activeListEntry{
+		ale := ActiveListEntry{
 			Done:               false,
 			Exception:          false,
 			LogicalDestination: ins.dest,
-			OldDestination:     p.workingState.RegisterMapTable[ins.dest],
+			OldDestination:     noPhysReg,
 			PC:                 insPc,
-		})
-
-		p.workingState.RegisterMapTable[ins.dest] = newDestRegs[i]
-
-		p.workingState.BusyBitTable[newDestRegs[i]] = true
+			dest:               newDestReg,
+		}
+		if ins.dest != noLogicReg {
+			ale.OldDestination = p.workingState.RegisterMapTable[ins.dest]
+			p.workingState.RegisterMapTable[ins.dest] = newDestReg
+			p.workingState.BusyBitTable[newDestReg] = true
+			p.workingState.regCluster[newDestReg] = cluster
+		}
+		p.workingState.ActiveList = append(p.workingState.ActiveList, ale)
 	}
 
 	p.workingState.DecodedPCs = nil
@@ -324,10 +442,18 @@ func (p *Processor) issue() {
 	}
 	for i := range p.workingState.alu {
 		alu := &p.workingState.alu[i]
+		if alu.assigned != nil {
+			// The ALU is stalled by a slow instruction.
+			continue
+		}
 		for j := range p.workingState.IntegerQueue {
 			iqe := &p.workingState.IntegerQueue[j]
+			if p.config.clustered() && iqe.cluster != p.config.clusterOf(i) {
+				continue
+			}
 			if iqe.ready() {
 				alu.assign(p.workingState.IntegerQueue.take(j))
+				p.notify(func(o Observer) { o.OnIssue(p.cycle, i, *alu.assigned) })
 				break
 			}
 		}
@@ -338,11 +464,14 @@ func (p *Processor) updateIntegerQueueReadiness() {
 	for i := range p.workingState.IntegerQueue {
 		iqe := &p.workingState.IntegerQueue[i]
 
-		if !iqe.OpAIsReady && !p.workingState.BusyBitTable[iqe.OpARegTag] {
+		if iqe.opASpeculative || iqe.opBSpeculative {
+			p.resolveOperands(iqe)
+		}
+		if !iqe.OpAIsReady && p.operandAvailable(iqe.OpARegTag, iqe.cluster) {
 			iqe.OpAIsReady = true
 			iqe.OpAValue = p.workingState.PhysicalRegisterFile[iqe.OpARegTag]
 		}
-		if !iqe.OpBIsReady && !p.workingState.BusyBitTable[iqe.OpBRegTag] {
+		if !iqe.OpBIsReady && p.operandAvailable(iqe.OpBRegTag, iqe.cluster) {
 			iqe.OpBIsReady = true
 			iqe.OpBValue = p.workingState.PhysicalRegisterFile[iqe.OpBRegTag]
 		}
@@ -359,20 +488,36 @@ func (p *Processor) execute() {
 		entry := alu.ready()
 		if entry != nil {
 			res, exc := alu.result()
+			p.notify(func(o Observer) { o.OnComplete(p.cycle, *entry, exc) })
 
 			ale := p.workingState.ActiveList.getEntryByPC(entry.PC)
 			ale.Done = true
 
 			if exc {
 				ale.Exception = true
-			} else {
+			} else if entry.DestRegister != noPhysReg {
 				p.workingState.PhysicalRegisterFile[entry.DestRegister] = res
 				p.workingState.BusyBitTable[entry.DestRegister] = false
+				p.workingState.regWrittenAt[entry.DestRegister] = p.cycle
 			}
 		}
 	}
 
+	if p.config.SpeculativeWakeup {
+		p.resolveSpeculativeOperands()
+	}
+	for i := range p.workingState.alu {
+		alu := &p.workingState.alu[i]
+		if alu.inProgress != nil && !alu.held {
+			alu.stall = p.extraLatency(alu.inProgress)
+		}
+	}
+
 	p.updateIntegerQueueReadiness()
+
+	if p.config.SpeculativeWakeup {
+		p.wakeupSpeculatively()
+	}
 }
 
 func (p *Processor) recover() {
@@ -384,9 +529,18 @@ func (p *Processor) recover() {
 	for i := 0; i < 4 && len(p.workingState.ActiveList) != 0; i++ {
 		ale := p.workingState.ActiveList[len(p.workingState.ActiveList)-1]
 		p.workingState.ActiveList = p.workingState.ActiveList[:len(p.workingState.ActiveList)-1]
+		if ale.LogicalDestination == noLogicReg {
+			continue
+		}
 
 		prevReg := p.workingState.RegisterMapTable[ale.LogicalDestination]
 		p.workingState.BusyBitTable[prevReg] = false
+		if ale.released {
+			// The old register may have been reallocated, the destination takes its place instead.
+			p.workingState.PhysicalRegisterFile[prevReg] = ale.releasedValue
+			p.workingState.regCluster[prevReg] = noCluster
+			continue
+		}
 		p.workingState.RegisterMapTable[ale.LogicalDestination] = ale.OldDestination
 		p.workingState.FreeList = append(p.workingState.FreeList, prevReg)
 	}
@@ -403,10 +557,23 @@ func (p *Processor) commit() {
 		if ale.Exception {
 			p.workingState.Exception = true
 			p.workingState.ExceptionPC = ale.PC
+			p.notify(func(o Observer) { o.OnException(p.cycle, ale.PC) })
 			break
 		}
-		p.workingState.FreeList = append(p.workingState.FreeList, ale.OldDestination)
 		p.workingState.ActiveList.pop()
+		p.stats.Committed++
+		value := uint64(0)
+		if ale.dest != noPhysReg {
+			if !ale.released {
+				p.workingState.FreeList = append(p.workingState.FreeList, ale.OldDestination)
+			}
+			value = p.workingState.PhysicalRegisterFile[ale.dest]
+		}
+		p.notify(func(o Observer) { o.OnCommit(p.cycle, ale, value) })
+	}
+
+	if !p.workingState.Exception && p.interruptPending() {
+		p.takeInterrupt()
 	}
 }
 
@@ -419,6 +586,7 @@ func (p *Processor) propagate() {
 	}
 	p.execute()
 	p.issue()
+	p.releaseEarly()
 	p.renameAndDispatch()
 	p.fetchAndDecode()
 }
@@ -427,36 +595,122 @@ func (p *Processor) latch() {
 	p.state = p.workingState
 }
 
-func (p *Processor) Simulate(instructions []string, output io.Writer) error {
-	err := p.parseInstructions(instructions)
-	if err != nil {
+// Load parses the program and resets the processor to its initial state.
+func (p *Processor) Load(program []string) error {
+	p.reset()
+	if err := p.parseInstructions(program); err != nil {
 		return err
 	}
 
 	p.dumpStateIntoLog()
 
-	for !p.end && (p.state.Exception || p.state.PC < uint64(len(p.instructions)) || len(p.state.ActiveList) != 0) {
-		p.propagate()
+	return nil
+}
 
-		p.latch()
+func (p *Processor) finished() bool {
+	return p.end || !(p.state.Exception || p.state.PC < uint64(len(p.instructions)) || len(p.state.ActiveList) != 0)
+}
 
-		p.dumpStateIntoLog()
+// Step simulates a single cycle of the loaded program, it reports whether the simulation has finished.
+func (p *Processor) Step() (done bool) {
+	if p.finished() {
+		return true
 	}
 
+	p.cycle++
+
+	p.propagate()
+
+	p.latch()
+
+	p.applyFaults()
+
+	p.dumpStateIntoLog()
+
+	return p.finished()
+}
+
+func (p *Processor) Stats() Stats {
+	stats := p.stats
+	stats.Cycles = p.cycle
+	return stats
+}
+
+// State returns a snapshot of the processor after the last simulated cycle.
+func (p *Processor) State() State {
+	return p.state.snapshot(p.cycle)
+}
+
+// DisableLog stops keeping the states in memory, for long runs logged by an observer or only measured.
+// WriteLog only writes the states dumped before the call.
+func (p *Processor) DisableLog() {
+	p.logDisabled = true
+}
+
+// WriteLog writes the state of every simulated cycle in the CS470 JSON format.
+func (p *Processor) WriteLog(output io.Writer) error {
 	return json.NewEncoder(output).Encode(p.log)
 }
 
-func New() *Processor {
-	var proc Processor
+func (p *Processor) Simulate(instructions []string, output io.Writer) error {
+	err := p.Load(instructions)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < 32; i++ {
-		proc.state.RegisterMapTable[i] = PhysReg(i)
+	for !p.Step() {
 	}
 
-	proc.state.FreeList = make([]PhysReg, 0, 32)
-	for i := PhysReg(32); i < PhysReg(64); i++ {
-		proc.state.FreeList = append(proc.state.FreeList, i)
+	return p.WriteLog(output)
+}
+
+func (p *Processor) reset() {
+	p.state = state{}
+	p.workingState = state{}
+	p.instructions = nil
+	p.log = nil
+	p.end = false
+	p.cycle = 0
+	p.interrupts = nil
+	p.stats = Stats{}
+	p.faults = nil
+	p.appliedFaults = nil
+	p.cache = dataCache{}
+	p.nextCluster = 0
+
+	for i := 0; i < logicRegisters; i++ {
+		p.state.RegisterMapTable[i] = PhysReg(i)
 	}
 
-	return &proc
+	p.state.PhysicalRegisterFile = make([]uint64, p.config.physicalRegisters())
+	p.state.BusyBitTable = make([]bool, p.config.physicalRegisters())
+	p.state.alu = make([]alu, p.config.ALUs)
+	p.state.regCluster = make([]int, p.config.physicalRegisters())
+	for i := range p.state.regCluster {
+		p.state.regCluster[i] = noCluster
+	}
+	p.state.regWrittenAt = make([]uint64, p.config.physicalRegisters())
+
+	p.state.FreeList = make([]PhysReg, 0, p.config.FreeListSize)
+	for i := PhysReg(logicRegisters); i < PhysReg(p.config.physicalRegisters()); i++ {
+		p.state.FreeList = append(p.state.FreeList, i)
+	}
+}
+
+func New() *Processor {
+	proc, _ := NewWithConfig(DefaultConfig())
+	return proc
+}
+
+// NewWithConfig creates an R10000-style core with the given structure sizes.
+func NewWithConfig(config Config) (*Processor, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	proc := Processor{config: config}
+
+	proc.reset()
+
+	return &proc, nil
 }
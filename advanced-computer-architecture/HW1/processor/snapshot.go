@@ -0,0 +1,63 @@
+package processor
+
+// ALUState is the content of the pipeline stages of a single ALU, nil means an empty stage.
+type ALUState struct {
+	Assigned   *IntegerQueueEntry
+	InProgress *IntegerQueueEntry
+	Done       *IntegerQueueEntry
+}
+
+// State is a read-only snapshot of the processor at the end of a cycle.
+type State struct {
+	Cycle uint64
+
+	PC                   uint64
+	PhysicalRegisterFile []uint64
+	DecodedPCs           []uint64
+	ExceptionPC          uint64
+	Exception            bool
+	RegisterMapTable     [32]PhysReg
+	FreeList             []PhysReg
+	BusyBitTable         []bool
+	ActiveList           []ActiveListEntry
+	IntegerQueue         []IntegerQueueEntry
+	Backpressure         bool
+	ALUs                 []ALUState
+}
+
+func copyEntry(e *IntegerQueueEntry) *IntegerQueueEntry {
+	if e == nil {
+		return nil
+	}
+	copied := *e
+	return &copied
+}
+
+func (s *state) snapshot(cycle uint64) State {
+	copied := s.copy()
+
+	snap := State{
+		Cycle:                cycle,
+		PC:                   copied.PC,
+		PhysicalRegisterFile: copied.PhysicalRegisterFile,
+		DecodedPCs:           copied.DecodedPCs,
+		ExceptionPC:          copied.ExceptionPC,
+		Exception:            copied.Exception,
+		RegisterMapTable:     copied.RegisterMapTable,
+		FreeList:             copied.FreeList,
+		BusyBitTable:         copied.BusyBitTable,
+		ActiveList:           copied.ActiveList,
+		IntegerQueue:         copied.IntegerQueue,
+		Backpressure:         copied.backpressure,
+		ALUs:                 make([]ALUState, len(s.alu)),
+	}
+	for i, a := range s.alu {
+		snap.ALUs[i] = ALUState{
+			Assigned:   copyEntry(a.assigned),
+			InProgress: copyEntry(a.inProgress),
+			Done:       copyEntry(a.done),
+		}
+	}
+
+	return snap
+}
@@ -0,0 +1,139 @@
+package processor
+
+// Geometry of the direct-mapped data cache that gives traced loads their variable latency.
+const (
+	cacheLines    = 64
+	cacheLineSize = 64
+)
+
+var loadOps = map[InstructionType]bool{
+	"lb": true, "lh": true, "lw": true, "ld": true, "lbu": true, "lhu": true, "lwu": true,
+}
+
+type dataCache struct {
+	tags  [cacheLines]uint64
+	valid [cacheLines]bool
+}
+
+// access looks the address up and allocates its line, it reports whether the access hit.
+func (c *dataCache) access(addr uint64) bool {
+	line := addr / cacheLineSize
+	set := line % cacheLines
+	hit := c.valid[set] && c.tags[set] == line
+	c.tags[set], c.valid[set] = line, true
+	return hit
+}
+
+// SetSpeculativeWakeup enables or disables the speculative wakeup of consumers.
+func (p *Processor) SetSpeculativeWakeup(enabled bool) {
+	p.config.SpeculativeWakeup = enabled
+}
+
+// SetLoadMissLatency sets the extra cycles of the traced loads that miss in the data cache.
+func (p *Processor) SetLoadMissLatency(cycles int) {
+	p.config.LoadMissLatency = cycles
+}
+
+// extraLatency returns the cycles the instruction spends in execution on top of the two ALU stages.
+// Only traced memory accesses reach the data cache, every other instruction has a fixed latency.
+func (p *Processor) extraLatency(iqe *IntegerQueueEntry) int {
+	if iqe.PC >= uint64(len(p.instructions)) {
+		return 0
+	}
+	ins := p.instructions[iqe.PC]
+	if ins.trace == nil || ins.trace.Addr == nil {
+		return 0
+	}
+	if p.cache.access(*ins.trace.Addr) || !loadOps[ins.type_] {
+		return 0
+	}
+	p.stats.LoadMisses++
+	return p.config.LoadMissLatency
+}
+
+// resolveSpeculativeOperands reads the operands bypassed to the instructions entering the second ALU stage.
+// An instruction whose producer did not deliver in the expected cycle is squashed and sent back to the
+// integer queue, it is issued again once the producer really completes.
+func (p *Processor) resolveSpeculativeOperands() {
+	for i := range p.workingState.alu {
+		alu := &p.workingState.alu[i]
+		if alu.inProgress == nil || (!alu.inProgress.opASpeculative && !alu.inProgress.opBSpeculative) {
+			continue
+		}
+
+		// The entry is shared with the latched state, update a copy.
+		entry := *alu.inProgress
+		replay := p.resolveOperands(&entry)
+		if replay {
+			alu.inProgress = nil
+			p.workingState.IntegerQueue = append(p.workingState.IntegerQueue, entry)
+			p.stats.Replays++
+		} else {
+			alu.inProgress = &entry
+		}
+	}
+}
+
+// speculativeIssues returns the number of instructions issued with a speculatively woken operand not read yet,
+// by cluster. They may be sent back to the integer queue, so each of them keeps an entry of its cluster reserved.
+func (p *Processor) speculativeIssues() []int {
+	issues := make([]int, p.config.Clusters)
+	for i := range p.workingState.alu {
+		alu := &p.workingState.alu[i]
+		for _, entry := range []*IntegerQueueEntry{alu.assigned, alu.inProgress} {
+			if entry != nil && (entry.opASpeculative || entry.opBSpeculative) {
+				issues[entry.cluster]++
+			}
+		}
+	}
+	return issues
+}
+
+// resolveOperands replaces the speculatively woken operands of the entry by their values.
+// The operands whose producer is still busy are marked as not ready, it reports whether there were any.
+func (p *Processor) resolveOperands(iqe *IntegerQueueEntry) (cancelled bool) {
+	if iqe.opASpeculative {
+		iqe.opASpeculative = false
+		if p.workingState.BusyBitTable[iqe.OpARegTag] {
+			iqe.OpAIsReady = false
+			cancelled = true
+		} else {
+			iqe.OpAValue = p.workingState.PhysicalRegisterFile[iqe.OpARegTag]
+		}
+	}
+	if iqe.opBSpeculative {
+		iqe.opBSpeculative = false
+		if p.workingState.BusyBitTable[iqe.OpBRegTag] {
+			iqe.OpBIsReady = false
+			cancelled = true
+		} else {
+			iqe.OpBValue = p.workingState.PhysicalRegisterFile[iqe.OpBRegTag]
+		}
+	}
+	return cancelled
+}
+
+// wakeupSpeculatively marks as ready the operands produced by the instructions that entered the second ALU
+// stage, assuming they complete in the next cycle. Their values are read when the consumers enter the
+// second stage in turn.
+func (p *Processor) wakeupSpeculatively() {
+	for i := range p.workingState.alu {
+		producer := p.workingState.alu[i].inProgress
+		if producer == nil || producer.DestRegister == noPhysReg || p.workingState.alu[i].held {
+			continue
+		}
+		for j := range p.workingState.IntegerQueue {
+			iqe := &p.workingState.IntegerQueue[j]
+			if iqe.cluster != producer.cluster && p.config.ClusterDelay != 0 {
+				// Values crossing clusters are not bypassed.
+				continue
+			}
+			if !iqe.OpAIsReady && iqe.OpARegTag == producer.DestRegister {
+				iqe.OpAIsReady, iqe.opASpeculative = true, true
+			}
+			if !iqe.OpBIsReady && iqe.OpBRegTag == producer.DestRegister {
+				iqe.OpBIsReady, iqe.opBSpeculative = true, true
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+)
+
+// Stats are the performance counters every core model reports.
+type Stats struct {
+	Cycles    uint64
+	Committed uint64
+	// Cycles in which the front end was stalled by backpressure.
+	Stalls uint64
+	// Breakdown of the stalls by the full structure, a single stall can count towards several of them.
+	ActiveListStalls   uint64
+	IntegerQueueStalls uint64
+	FreeListStalls     uint64
+	// Physical registers freed before the commit of the instruction overwriting them.
+	EarlyReleases uint64
+	// Instructions squashed after a speculative wakeup and the load misses that caused most of them.
+	Replays    uint64
+	LoadMisses uint64
+	// Operands dispatched before their value produced in another cluster has reached the cluster of the reader.
+	CrossClusterReads uint64
+}
+
+func (s *Stats) countStall(activeListFull, integerQueueFull, freeListEmpty bool) {
+	s.Stalls++
+	if activeListFull {
+		s.ActiveListStalls++
+	}
+	if integerQueueFull {
+		s.IntegerQueueStalls++
+	}
+	if freeListEmpty {
+		s.FreeListStalls++
+	}
+}
+
+func (s Stats) IPC() float64 {
+	if s.Cycles == 0 {
+		return 0
+	}
+	return float64(s.Committed) / float64(s.Cycles)
+}
+
+// Write prints the statistics as "name value" lines.
+func (s Stats) Write(output io.Writer) error {
+	_, err := fmt.Fprintf(output, "cycles %d\ncommitted %d\nipc %.4f\nstalls %d\nactive_list_stalls %d\ninteger_queue_stalls %d\nfree_list_stalls %d\nearly_releases %d\nreplays %d\nload_misses %d\ncross_cluster_reads %d\n",
+		s.Cycles, s.Committed, s.IPC(), s.Stalls, s.ActiveListStalls, s.IntegerQueueStalls, s.FreeListStalls, s.EarlyReleases, s.Replays, s.LoadMisses, s.CrossClusterReads)
+	return err
+}
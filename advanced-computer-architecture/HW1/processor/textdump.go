@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// TextDumper renders the state of every cycle as aligned tables for humans reviewing a trace.
+// Busy physical registers are marked with '*'.
+type TextDumper struct {
+	BaseObserver
+	proc   *Processor
+	output *bufio.Writer
+	err    error
+}
+
+func NewTextDumper(proc *Processor, output io.Writer) *TextDumper {
+	return &TextDumper{
+		proc:   proc,
+		output: bufio.NewWriter(output),
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func (t *TextDumper) physReg(s *State, r PhysReg) string {
+	if r == noPhysReg {
+		return "-"
+	}
+	if int(r) < len(s.BusyBitTable) && s.BusyBitTable[r] {
+		return fmt.Sprintf("p%d*", r)
+	}
+	return fmt.Sprintf("p%d", r)
+}
+
+func (t *TextDumper) operand(ready bool, tag PhysReg, value uint64) string {
+	if ready {
+		return fmt.Sprintf("%d", value)
+	}
+	return fmt.Sprintf("wait p%d", tag)
+}
+
+func (t *TextDumper) stage(e *IntegerQueueEntry) string {
+	if e == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d: %s", e.PC, t.proc.Disassemble(e.PC))
+}
+
+func (t *TextDumper) table(title string, write func(w io.Writer)) {
+	fmt.Fprintln(t.output, title)
+	w := tabwriter.NewWriter(t.output, 0, 0, 2, ' ', 0)
+	write(w)
+	w.Flush()
+	fmt.Fprintln(t.output)
+}
+
+func (t *TextDumper) OnCycleEnd(s State) {
+	if t.err != nil {
+		return
+	}
+
+	decoded := make([]string, len(s.DecodedPCs))
+	for i, pc := range s.DecodedPCs {
+		decoded[i] = fmt.Sprint(pc)
+	}
+	fmt.Fprintf(t.output, "=== cycle %d ===\n", s.Cycle)
+	fmt.Fprintf(t.output, "PC: %d  decoded: [%s]  backpressure: %s  exception: %s",
+		s.PC, strings.Join(decoded, " "), yesNo(s.Backpressure), yesNo(s.Exception))
+	if s.Exception {
+		fmt.Fprintf(t.output, " at %d", s.ExceptionPC)
+	}
+	fmt.Fprint(t.output, "\n\n")
+
+	t.table("Rename map", func(w io.Writer) {
+		const perRow = 8
+		for row := 0; row < len(s.RegisterMapTable); row += perRow {
+			cells := make([]string, 0, perRow)
+			for i := row; i < row+perRow && i < len(s.RegisterMapTable); i++ {
+				cells = append(cells, fmt.Sprintf("x%d -> %s", i, t.physReg(&s, s.RegisterMapTable[i])))
+			}
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+		}
+	})
+
+	t.table("Integer queue", func(w io.Writer) {
+		fmt.Fprintln(w, "pc\tdest\topA\topB\tready\tinstruction")
+		for _, e := range s.IntegerQueue {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.PC, t.physReg(&s, e.DestRegister),
+				t.operand(e.OpAIsReady, e.OpARegTag, e.OpAValue), t.operand(e.OpBIsReady, e.OpBRegTag, e.OpBValue),
+				yesNo(e.ready()), t.proc.Disassemble(e.PC))
+		}
+	})
+
+	t.table("ALUs", func(w io.Writer) {
+		fmt.Fprintln(w, "alu\tassigned\tin progress\tdone")
+		for i, a := range s.ALUs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i, t.stage(a.Assigned), t.stage(a.InProgress), t.stage(a.Done))
+		}
+	})
+
+	t.table("Active list", func(w io.Writer) {
+		fmt.Fprintln(w, "pc\tdest\told\tdone\texception\tinstruction")
+		for _, e := range s.ActiveList {
+			dest := "-"
+			if e.LogicalDestination != noLogicReg {
+				dest = e.LogicalDestination.String()
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.PC, dest, t.physReg(&s, e.OldDestination),
+				yesNo(e.Done), yesNo(e.Exception), t.proc.Disassemble(e.PC))
+		}
+	})
+
+	free := make([]string, len(s.FreeList))
+	for i, r := range s.FreeList {
+		free[i] = fmt.Sprintf("p%d", r)
+	}
+	fmt.Fprintf(t.output, "Free list (%d): %s\n\n", len(s.FreeList), strings.Join(free, " "))
+
+	t.err = t.output.Flush()
+}
+
+// Err returns the first error encountered while writing the dump.
+func (t *TextDumper) Err() error {
+	return t.err
+}
@@ -0,0 +1,69 @@
+package processor
+
+// TimelineEntry is the life of an instruction in the pipeline, a cycle is 0 when the stage was never reached.
+type TimelineEntry struct {
+	PC          uint64
+	Instruction string
+	Dispatch    uint64
+	Issue       uint64
+	ALU         int
+	Complete    uint64
+	Commit      uint64
+	Exception   bool
+}
+
+// TimelineRecorder collects the pipeline timeline of every dispatched instruction, in dispatch order.
+type TimelineRecorder struct {
+	BaseObserver
+	proc    *Processor
+	entries []TimelineEntry
+	byPC    map[uint64]int
+}
+
+func NewTimelineRecorder(proc *Processor) *TimelineRecorder {
+	return &TimelineRecorder{
+		proc: proc,
+		byPC: make(map[uint64]int),
+	}
+}
+
+func (t *TimelineRecorder) entry(pc uint64) *TimelineEntry {
+	i, ok := t.byPC[pc]
+	if !ok {
+		return nil
+	}
+	return &t.entries[i]
+}
+
+func (t *TimelineRecorder) OnDispatch(cycle uint64, entry IntegerQueueEntry) {
+	t.byPC[entry.PC] = len(t.entries)
+	t.entries = append(t.entries, TimelineEntry{
+		PC:          entry.PC,
+		Instruction: t.proc.Disassemble(entry.PC),
+		Dispatch:    cycle,
+		ALU:         -1,
+	})
+}
+
+func (t *TimelineRecorder) OnIssue(cycle uint64, alu int, entry IntegerQueueEntry) {
+	if e := t.entry(entry.PC); e != nil {
+		e.Issue, e.ALU = cycle, alu
+	}
+}
+
+func (t *TimelineRecorder) OnComplete(cycle uint64, entry IntegerQueueEntry, exception bool) {
+	if e := t.entry(entry.PC); e != nil {
+		e.Complete, e.Exception = cycle, exception
+	}
+}
+
+func (t *TimelineRecorder) OnCommit(cycle uint64, entry ActiveListEntry, _ uint64) {
+	if e := t.entry(entry.PC); e != nil {
+		e.Commit = cycle
+	}
+}
+
+// Entries returns the recorded timeline, instructions squashed by an exception have no commit cycle.
+func (t *TimelineRecorder) Entries() []TimelineEntry {
+	return t.entries
+}
@@ -0,0 +1,426 @@
+package processor
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// RobTag identifies a reorder buffer entry, noTag marks a value that is already available.
+type RobTag int8
+
+const noTag RobTag = -1
+
+const (
+	robSize              = 32
+	reservationStations  = 32
+	defaultCommonBusSize = 2
+)
+
+type ReservationStation struct {
+	OpCode string
+	Vj     uint64
+	Vk     uint64
+	Qj     RobTag
+	Qk     RobTag
+	Dest   RobTag
+	PC     uint64
+}
+
+func (rs ReservationStation) ready() bool {
+	return rs.Qj == noTag && rs.Qk == noTag
+}
+
+type ReorderBufferEntry struct {
+	Tag         RobTag
+	Done        bool
+	Exception   bool
+	Destination LogicReg
+	Value       uint64
+	PC          uint64
+}
+
+type CommonDataBusEntry struct {
+	Tag   RobTag
+	Value uint64
+}
+
+type tomasuloALU struct {
+	assigned   *ReservationStation
+	inProgress *ReservationStation
+	done       *ReservationStation
+}
+
+func (a *tomasuloALU) progress() {
+	if a.done != nil {
+		return
+	}
+	a.done = a.inProgress
+	a.inProgress = a.assigned
+	a.assigned = nil
+}
+
+type tomasuloState struct {
+	PC                  uint64
+	DecodedPCs          []uint64
+	ExceptionPC         uint64
+	Exception           bool
+	RegisterFile        [32]uint64
+	RegisterStatus      [32]RobTag
+	ReservationStations []ReservationStation
+	ReorderBuffer       []ReorderBufferEntry
+	CommonDataBus       []CommonDataBusEntry
+
+	backpressure bool
+	nextTag      RobTag
+
+	alu [4]tomasuloALU
+}
+
+func (s *tomasuloState) copy() tomasuloState {
+	copied := *s
+
+	copied.DecodedPCs = append(make([]uint64, 0, len(s.DecodedPCs)), s.DecodedPCs...)
+	copied.ReservationStations = append(make([]ReservationStation, 0, len(s.ReservationStations)), s.ReservationStations...)
+	copied.ReorderBuffer = append(make([]ReorderBufferEntry, 0, len(s.ReorderBuffer)), s.ReorderBuffer...)
+	copied.CommonDataBus = append(make([]CommonDataBusEntry, 0, len(s.CommonDataBus)), s.CommonDataBus...)
+
+	return copied
+}
+
+func (s *tomasuloState) robEntry(tag RobTag) *ReorderBufferEntry {
+	for i := range s.ReorderBuffer {
+		if s.ReorderBuffer[i].Tag == tag {
+			return &s.ReorderBuffer[i]
+		}
+	}
+	return nil
+}
+
+// Tomasulo is a core model with reservation stations, a common data bus of limited width
+// and a reorder buffer that holds the results until they are committed to the register file.
+type Tomasulo struct {
+	state         tomasuloState
+	workingState  tomasuloState
+	instructions  []instruction
+	log           []tomasuloState
+	end           bool
+	cycle         uint64
+	interrupts    []uint64
+	commonBusSize int
+	stats         Stats
+}
+
+func NewTomasulo() *Tomasulo {
+	var t Tomasulo
+
+	t.commonBusSize = defaultCommonBusSize
+	t.reset()
+
+	return &t
+}
+
+// SetCommonBusSize sets how many results can be broadcast in a single cycle.
+func (t *Tomasulo) SetCommonBusSize(size int) {
+	t.commonBusSize = size
+}
+
+func (t *Tomasulo) reset() {
+	t.state = tomasuloState{}
+	t.workingState = tomasuloState{}
+	t.instructions = nil
+	t.log = nil
+	t.end = false
+	t.cycle = 0
+	t.interrupts = nil
+	t.stats = Stats{}
+
+	for i := range t.state.RegisterStatus {
+		t.state.RegisterStatus[i] = noTag
+	}
+}
+
+func (t *Tomasulo) Load(program []string) (err error) {
+	t.reset()
+
+	var interrupts []uint64
+	t.instructions, interrupts, err = parseProgram(program)
+	if err != nil {
+		return err
+	}
+	for _, cycle := range interrupts {
+		t.ScheduleInterrupt(cycle)
+	}
+
+	t.dumpStateIntoLog()
+
+	return nil
+}
+
+func (t *Tomasulo) ScheduleInterrupt(cycle uint64) {
+	t.interrupts = append(t.interrupts, cycle)
+	sort.Slice(t.interrupts, func(i, j int) bool { return t.interrupts[i] < t.interrupts[j] })
+}
+
+func (t *Tomasulo) finished() bool {
+	return t.end || !(t.state.Exception || t.state.PC < uint64(len(t.instructions)) ||
+		len(t.state.DecodedPCs) != 0 || len(t.state.ReorderBuffer) != 0)
+}
+
+func (t *Tomasulo) Step() (done bool) {
+	if t.finished() {
+		return true
+	}
+
+	t.cycle++
+
+	t.propagate()
+
+	t.state = t.workingState
+
+	t.dumpStateIntoLog()
+
+	return t.finished()
+}
+
+func (t *Tomasulo) WriteLog(output io.Writer) error {
+	return json.NewEncoder(output).Encode(t.log)
+}
+
+func (t *Tomasulo) Stats() Stats {
+	stats := t.stats
+	stats.Cycles = t.cycle
+	return stats
+}
+
+func (t *Tomasulo) dumpStateIntoLog() {
+	s := t.state.copy()
+	if s.DecodedPCs == nil {
+		s.DecodedPCs = make([]uint64, 0)
+	}
+	if s.ReservationStations == nil {
+		s.ReservationStations = make([]ReservationStation, 0)
+	}
+	if s.ReorderBuffer == nil {
+		s.ReorderBuffer = make([]ReorderBufferEntry, 0)
+	}
+	if s.CommonDataBus == nil {
+		s.CommonDataBus = make([]CommonDataBusEntry, 0)
+	}
+	t.log = append(t.log, s)
+}
+
+func (t *Tomasulo) propagate() {
+	t.workingState = t.state.copy()
+
+	t.commit()
+	if t.end {
+		return
+	}
+	t.writeBack()
+	t.execute()
+	t.issue()
+	t.dispatch()
+	t.fetchAndDecode()
+}
+
+func (t *Tomasulo) commit() {
+	if t.workingState.Exception {
+		// The reorder buffer holds all speculative values, so the flush takes a single cycle.
+		t.workingState.ReorderBuffer = nil
+		t.workingState.CommonDataBus = nil
+		t.workingState.Exception = false
+		t.end = true
+		return
+	}
+
+	for i := 0; i < 4 && len(t.workingState.ReorderBuffer) != 0 && t.workingState.ReorderBuffer[0].Done; i++ {
+		rob := t.workingState.ReorderBuffer[0]
+		if rob.Exception {
+			t.raiseException(rob.PC)
+			return
+		}
+
+		t.workingState.RegisterFile[rob.Destination] = rob.Value
+		if t.workingState.RegisterStatus[rob.Destination] == rob.Tag {
+			t.workingState.RegisterStatus[rob.Destination] = noTag
+		}
+		t.workingState.ReorderBuffer = t.workingState.ReorderBuffer[1:]
+		t.stats.Committed++
+	}
+
+	if len(t.interrupts) != 0 && t.interrupts[0] <= t.cycle {
+		t.interrupts = t.interrupts[1:]
+		switch {
+		case len(t.workingState.ReorderBuffer) != 0:
+			t.raiseException(t.workingState.ReorderBuffer[0].PC)
+		case len(t.workingState.DecodedPCs) != 0:
+			t.raiseException(t.workingState.DecodedPCs[0])
+		default:
+			t.raiseException(t.workingState.PC)
+		}
+	}
+}
+
+func (t *Tomasulo) raiseException(pc uint64) {
+	t.workingState.Exception = true
+	t.workingState.ExceptionPC = pc
+	for i := range t.workingState.RegisterStatus {
+		t.workingState.RegisterStatus[i] = noTag
+	}
+	t.workingState.ReservationStations = nil
+	t.workingState.alu = [4]tomasuloALU{}
+	t.workingState.DecodedPCs = nil
+	t.workingState.PC = 0x10000
+}
+
+// writeBack broadcasts the oldest finished results on the common data bus, the other ALUs stall.
+func (t *Tomasulo) writeBack() {
+	if t.workingState.Exception {
+		return
+	}
+
+	var finished []int
+	for i := range t.workingState.alu {
+		if t.workingState.alu[i].done != nil {
+			finished = append(finished, i)
+		}
+	}
+	robIdx := func(tag RobTag) int {
+		for i, rob := range t.workingState.ReorderBuffer {
+			if rob.Tag == tag {
+				return i
+			}
+		}
+		return -1
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return robIdx(t.workingState.alu[finished[i]].done.Dest) < robIdx(t.workingState.alu[finished[j]].done.Dest)
+	})
+
+	t.workingState.CommonDataBus = nil
+	for _, i := range finished {
+		if len(t.workingState.CommonDataBus) == t.commonBusSize {
+			break
+		}
+		a := &t.workingState.alu[i]
+		res, exc := compute(a.done.OpCode, a.done.Vj, a.done.Vk)
+
+		rob := t.workingState.robEntry(a.done.Dest)
+		rob.Done = true
+		rob.Exception = exc
+		rob.Value = res
+		a.done = nil
+
+		if exc {
+			continue
+		}
+		t.workingState.CommonDataBus = append(t.workingState.CommonDataBus, CommonDataBusEntry{
+			Tag:   rob.Tag,
+			Value: res,
+		})
+		for j := range t.workingState.ReservationStations {
+			rs := &t.workingState.ReservationStations[j]
+			if rs.Qj == rob.Tag {
+				rs.Qj, rs.Vj = noTag, res
+			}
+			if rs.Qk == rob.Tag {
+				rs.Qk, rs.Vk = noTag, res
+			}
+		}
+	}
+}
+
+func (t *Tomasulo) execute() {
+	if t.workingState.Exception {
+		return
+	}
+	for i := range t.workingState.alu {
+		t.workingState.alu[i].progress()
+	}
+}
+
+func (t *Tomasulo) issue() {
+	if t.workingState.Exception {
+		return
+	}
+	for i := range t.workingState.alu {
+		a := &t.workingState.alu[i]
+		if a.assigned != nil {
+			continue
+		}
+		for j, rs := range t.workingState.ReservationStations {
+			if rs.ready() {
+				issued := rs
+				a.assigned = &issued
+				t.workingState.ReservationStations = append(t.workingState.ReservationStations[:j], t.workingState.ReservationStations[j+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (t *Tomasulo) operand(r LogicReg) (uint64, RobTag) {
+	tag := t.workingState.RegisterStatus[r]
+	if tag == noTag {
+		return t.workingState.RegisterFile[r], noTag
+	}
+	if rob := t.workingState.robEntry(tag); rob.Done {
+		return rob.Value, noTag
+	}
+	return 0, tag
+}
+
+func (t *Tomasulo) dispatch() {
+	if t.workingState.Exception {
+		return
+	}
+
+	n := len(t.workingState.DecodedPCs)
+	t.workingState.backpressure = len(t.workingState.ReorderBuffer)+n > robSize ||
+		len(t.workingState.ReservationStations)+n > reservationStations
+	if t.workingState.backpressure {
+		t.stats.Stalls++
+		return
+	}
+
+	for _, pc := range t.workingState.DecodedPCs {
+		ins := t.instructions[pc]
+		tag := t.workingState.nextTag
+		t.workingState.nextTag = (t.workingState.nextTag + 1) % robSize
+
+		rs := ReservationStation{
+			OpCode: ins.type_.toOpCode(),
+			Qk:     noTag,
+			Dest:   tag,
+			PC:     pc,
+		}
+		rs.Vj, rs.Qj = t.operand(ins.opA)
+		if ins.type_ == addi {
+			rs.Vk = i64Tou64(ins.opB.imm)
+		} else {
+			rs.Vk, rs.Qk = t.operand(ins.opB.reg)
+		}
+		t.workingState.ReservationStations = append(t.workingState.ReservationStations, rs)
+
+		t.workingState.ReorderBuffer = append(t.workingState.ReorderBuffer, ReorderBufferEntry{
+			Tag:         tag,
+			Destination: ins.dest,
+			PC:          pc,
+		})
+		t.workingState.RegisterStatus[ins.dest] = tag
+	}
+
+	t.workingState.DecodedPCs = nil
+}
+
+func (t *Tomasulo) fetchAndDecode() {
+	if t.workingState.Exception || t.workingState.backpressure {
+		return
+	}
+
+	for i := 0; i < 4 && t.workingState.PC < uint64(len(t.instructions)); i++ {
+		t.workingState.DecodedPCs = append(t.workingState.DecodedPCs, t.workingState.PC)
+		t.workingState.PC++
+	}
+}
@@ -0,0 +1,47 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+)
+
+// CommitTracer writes one line per committed instruction in the format of Spike's --log-commits.
+// PCs are byte addresses (index * 4) or the recorded PCs of a trace, the cycle and the disassembly are appended after a ';'
+// so the prefix of every line can be diffed directly against a Spike log.
+type CommitTracer struct {
+	BaseObserver
+	proc   *Processor
+	output io.Writer
+	err    error
+}
+
+func NewCommitTracer(proc *Processor, output io.Writer) *CommitTracer {
+	return &CommitTracer{
+		proc:   proc,
+		output: output,
+	}
+}
+
+func (t *CommitTracer) OnCommit(cycle uint64, entry ActiveListEntry, value uint64) {
+	if t.err != nil {
+		return
+	}
+	ins := t.proc.instructions[entry.PC]
+	pc := entry.PC * 4
+	if ins.trace != nil {
+		pc = ins.trace.PC
+	}
+	if entry.LogicalDestination == noLogicReg {
+		// Like Spike, instructions without a destination only report their PC.
+		_, t.err = fmt.Fprintf(t.output, "core   0: 3 0x%016x (0x%08x) ; cycle %d: %s\n",
+			pc, ins.encode(), cycle, ins)
+		return
+	}
+	_, t.err = fmt.Fprintf(t.output, "core   0: 3 0x%016x (0x%08x) x%-2d 0x%016x ; cycle %d: %s\n",
+		pc, ins.encode(), entry.LogicalDestination, value, cycle, ins)
+}
+
+// Err returns the first error encountered while writing the trace.
+func (t *CommitTracer) Err() error {
+	return t.err
+}
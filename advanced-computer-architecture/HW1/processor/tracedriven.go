@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Operands that are absent in traced instructions, e.g. the destination of a store.
+const (
+	noLogicReg LogicReg = -1
+	noPhysReg  PhysReg  = -1
+)
+
+// TraceEntry is a dynamically executed instruction recorded by a functional simulator or an emulator.
+type TraceEntry struct {
+	// PC is the address of the instruction in the traced program, it is only used for display.
+	PC uint64 `json:"pc"`
+	Op string `json:"op"`
+	// Dest is the destination register, nil for instructions without one such as stores and branches.
+	Dest *int `json:"dest,omitempty"`
+	// Srcs are the source registers, at most two.
+	Srcs []int  `json:"srcs,omitempty"`
+	Imm  *int64 `json:"imm,omitempty"`
+	// Addr is the memory address accessed by loads and stores.
+	Addr *uint64 `json:"addr,omitempty"`
+	// Value is the recorded result, it is required for opcodes the model cannot compute.
+	Value *uint64 `json:"value,omitempty"`
+}
+
+// ReadTrace decodes a trace stored as a JSON array of entries.
+func ReadTrace(input io.Reader) ([]TraceEntry, error) {
+	var trace []TraceEntry
+	if err := json.NewDecoder(input).Decode(&trace); err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+func traceReg(r int) (LogicReg, error) {
+	if r < 0 || r >= logicRegisters {
+		return 0, fmt.Errorf("invalid register: x%d", r)
+	}
+	return LogicReg(r), nil
+}
+
+func (e TraceEntry) instruction() (ins instruction, err error) {
+	ins.type_ = InstructionType(e.Op)
+	ins.dest, ins.opA, ins.opB.reg = noLogicReg, noLogicReg, noLogicReg
+	ins.trace = &e
+
+	if e.Dest != nil {
+		if ins.dest, err = traceReg(*e.Dest); err != nil {
+			return ins, err
+		}
+	}
+
+	if len(e.Srcs) > 2 {
+		return ins, fmt.Errorf("too many source registers: %s", e.Op)
+	}
+	if len(e.Srcs) > 0 {
+		if ins.opA, err = traceReg(e.Srcs[0]); err != nil {
+			return ins, err
+		}
+	}
+	if len(e.Srcs) > 1 {
+		if ins.opB.reg, err = traceReg(e.Srcs[1]); err != nil {
+			return ins, err
+		}
+	}
+	if e.Imm != nil {
+		ins.opB.imm = *e.Imm
+	}
+
+	if ins.dest == noLogicReg && e.Value == nil {
+		// The result of stores and branches is never written, they only occupy an ALU.
+		e.Value = new(uint64)
+	}
+	if e.Value != nil {
+		return ins, nil
+	}
+	if _, err = parseMnemonic(e.Op); err != nil {
+		return ins, fmt.Errorf("no recorded value for %s at 0x%x: %w", e.Op, e.PC, err)
+	}
+	if ins.opA == noLogicReg || (ins.type_ == addi) != (e.Imm != nil) || (ins.type_ != addi && ins.opB.reg == noLogicReg) {
+		return ins, fmt.Errorf("missing operands of %s at 0x%x", e.Op, e.PC)
+	}
+	return ins, nil
+}
+
+// LoadTrace resets the processor to replay a dynamic instruction trace instead of a static program.
+// Every entry is fetched once in order, the PCs of the log are the positions in the trace.
+// Results are taken from the recorded values, or computed by the model for known opcodes without one.
+func (p *Processor) LoadTrace(trace []TraceEntry) error {
+	p.reset()
+	p.instructions = make([]instruction, 0, len(trace))
+	for _, e := range trace {
+		ins, err := e.instruction()
+		if err != nil {
+			return err
+		}
+		p.instructions = append(p.instructions, ins)
+	}
+
+	p.dumpStateIntoLog()
+
+	return nil
+}
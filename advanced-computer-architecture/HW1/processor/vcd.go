@@ -0,0 +1,213 @@
+package processor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// opCodes numbers the opcodes in the waveforms, 0 marks an empty stage. The opcodes of traces that the model
+// does not know take the next numbers in the order they first execute, each announced by a comment.
+var opCodes = map[string]uint64{
+	add.toOpCode():  1,
+	sub.toOpCode():  2,
+	mulu.toOpCode(): 3,
+	divu.toOpCode(): 4,
+	remu.toOpCode(): 5,
+}
+
+type vcdSignal struct {
+	id    string
+	name  string
+	width int
+	value string
+}
+
+// VCDWriter dumps the pipeline signals of every cycle as a Value Change Dump, one cycle is one nanosecond.
+type VCDWriter struct {
+	BaseObserver
+	output  *bufio.Writer
+	signals []*vcdSignal
+	byName  map[string]*vcdSignal
+	opCodes map[string]uint64
+	err     error
+}
+
+func NewVCDWriter(output io.Writer) *VCDWriter {
+	return &VCDWriter{
+		output:  bufio.NewWriter(output),
+		byName:  make(map[string]*vcdSignal),
+		opCodes: make(map[string]uint64),
+	}
+}
+
+func vcdID(n int) string {
+	const first, last = '!', '~'
+	id := ""
+	for {
+		id += string(rune(first + n%(last-first+1)))
+		n /= last - first + 1
+		if n == 0 {
+			return id
+		}
+		n--
+	}
+}
+
+func (v *VCDWriter) declare(name string, width int) {
+	s := &vcdSignal{
+		id:    vcdID(len(v.signals)),
+		name:  name,
+		width: width,
+	}
+	v.signals = append(v.signals, s)
+	v.byName[name] = s
+}
+
+func (v *VCDWriter) declareSignals(s State) {
+	v.declare("pc", 64)
+	v.declare("decoded_count", 3)
+	for i := 0; i < fetchWidth; i++ {
+		v.declare(fmt.Sprintf("decoded_pc_%d", i), 64)
+	}
+	v.declare("backpressure", 1)
+	for i := range s.ALUs {
+		for _, stage := range []string{"assigned", "in_progress", "done"} {
+			v.declare(fmt.Sprintf("alu%d_%s_valid", i, stage), 1)
+			v.declare(fmt.Sprintf("alu%d_%s_opcode", i, stage), 16)
+			v.declare(fmt.Sprintf("alu%d_%s_pc", i, stage), 64)
+		}
+	}
+	v.declare("busy", len(s.BusyBitTable))
+	v.declare("free_list_length", 16)
+	v.declare("active_list_length", 16)
+	v.declare("active_list_head", 64)
+	v.declare("active_list_tail", 64)
+	v.declare("exception", 1)
+	v.declare("exception_pc", 64)
+}
+
+func (v *VCDWriter) writeHeader() {
+	fmt.Fprintln(v.output, "$version OoO470 $end")
+	fmt.Fprintln(v.output, "$timescale 1ns $end")
+	fmt.Fprintln(v.output, "$scope module ooo470 $end")
+	for _, s := range v.signals {
+		fmt.Fprintf(v.output, "$var wire %d %s %s $end\n", s.width, s.id, s.name)
+	}
+	fmt.Fprintln(v.output, "$upscope $end")
+	fmt.Fprintln(v.output, "$enddefinitions $end")
+}
+
+func (v *VCDWriter) opCode(op string) uint64 {
+	if code, ok := opCodes[op]; ok {
+		return code
+	}
+	code, ok := v.opCodes[op]
+	if !ok {
+		code = uint64(len(opCodes) + len(v.opCodes) + 1)
+		v.opCodes[op] = code
+		fmt.Fprintf(v.output, "$comment opcode %d is %s $end\n", code, op)
+	}
+	return code
+}
+
+func (v *VCDWriter) set(name string, value uint64) {
+	s := v.byName[name]
+	if s.width == 1 {
+		v.setRaw(s, fmt.Sprintf("%d", value&1))
+	} else {
+		v.setRaw(s, fmt.Sprintf("b%b", value))
+	}
+}
+
+func (v *VCDWriter) setBool(name string, value bool) {
+	if value {
+		v.set(name, 1)
+	} else {
+		v.set(name, 0)
+	}
+}
+
+func (v *VCDWriter) setRaw(s *vcdSignal, value string) {
+	if s.value == value {
+		return
+	}
+	s.value = value
+	if s.width == 1 {
+		fmt.Fprintf(v.output, "%s%s\n", value, s.id)
+	} else {
+		fmt.Fprintf(v.output, "%s %s\n", value, s.id)
+	}
+}
+
+func (v *VCDWriter) OnCycleEnd(s State) {
+	if v.err != nil {
+		return
+	}
+	if len(v.signals) == 0 {
+		v.declareSignals(s)
+		v.writeHeader()
+	}
+
+	fmt.Fprintf(v.output, "#%d\n", s.Cycle)
+
+	v.set("pc", s.PC)
+	v.set("decoded_count", uint64(len(s.DecodedPCs)))
+	for i := 0; i < fetchWidth; i++ {
+		pc := uint64(0)
+		if i < len(s.DecodedPCs) {
+			pc = s.DecodedPCs[i]
+		}
+		v.set(fmt.Sprintf("decoded_pc_%d", i), pc)
+	}
+	v.setBool("backpressure", s.Backpressure)
+
+	for i, a := range s.ALUs {
+		stages := []struct {
+			name  string
+			entry *IntegerQueueEntry
+		}{{"assigned", a.Assigned}, {"in_progress", a.InProgress}, {"done", a.Done}}
+		for _, stage := range stages {
+			prefix, entry := fmt.Sprintf("alu%d_%s", i, stage.name), stage.entry
+			v.setBool(prefix+"_valid", entry != nil)
+			if entry != nil {
+				v.set(prefix+"_opcode", v.opCode(entry.OpCode))
+				v.set(prefix+"_pc", entry.PC)
+			} else {
+				v.set(prefix+"_opcode", 0)
+				v.set(prefix+"_pc", 0)
+			}
+		}
+	}
+
+	var busy strings.Builder
+	busy.WriteString("b")
+	// The most significant bit is the last physical register.
+	for i := len(s.BusyBitTable) - 1; i >= 0; i-- {
+		if s.BusyBitTable[i] {
+			busy.WriteByte('1')
+		} else {
+			busy.WriteByte('0')
+		}
+	}
+	v.setRaw(v.byName["busy"], busy.String())
+
+	v.set("free_list_length", uint64(len(s.FreeList)))
+	v.set("active_list_length", uint64(len(s.ActiveList)))
+	head, tail := uint64(0), uint64(0)
+	if len(s.ActiveList) != 0 {
+		head, tail = s.ActiveList[0].PC, s.ActiveList[len(s.ActiveList)-1].PC
+	}
+	v.set("active_list_head", head)
+	v.set("active_list_tail", tail)
+	v.setBool("exception", s.Exception)
+	v.set("exception_pc", s.ExceptionPC)
+
+	v.err = v.output.Flush()
+}
+
+// Err returns the first error encountered while writing the waveforms.
+func (v *VCDWriter) Err() error {
+	return v.err
+}
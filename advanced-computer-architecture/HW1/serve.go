@@ -0,0 +1,128 @@
+package main
+
+import (
+	"HW1/processor"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+//go:embed web/index.html
+var webUI []byte
+
+// maxProgramSize bounds the body of a simulation request.
+const maxProgramSize = 1 << 20
+
+type simulation struct {
+	States   []processor.State
+	Timeline []processor.TimelineEntry
+	Stats    processor.Stats
+}
+
+func simulate(program []string) (*simulation, error) {
+	proc := processor.New()
+	var sim simulation
+	timeline := processor.NewTimelineRecorder(proc)
+	proc.AddObserver(timeline)
+	proc.AddObserver(stateCollector{states: &sim.States})
+	proc.DisableLog()
+
+	if err := proc.Load(program); err != nil {
+		return nil, err
+	}
+	for !proc.Step() {
+	}
+
+	sim.Timeline = timeline.Entries()
+	sim.Stats = proc.Stats()
+	return &sim, nil
+}
+
+type stateCollector struct {
+	processor.BaseObserver
+	states *[]processor.State
+}
+
+func (c stateCollector) OnCycleEnd(s processor.State) {
+	*c.states = append(*c.states, s)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func newServeMux(program []string) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webUI)
+	})
+
+	// The program given on the command line, if any, to fill the editor.
+	mux.HandleFunc("/api/program", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, program)
+	})
+
+	// Simulates the program posted in the input format and returns the state of every cycle and the timeline.
+	mux.HandleFunc("/api/simulate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var posted []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProgramSize)).Decode(&posted); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sim, err := simulate(posted)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, sim)
+	})
+
+	return mux
+}
+
+// runServe serves the pipeline viewer on a local address.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8470", "address to listen on")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "./OoO470 serve [-addr <host:port>] [/path/to/input.json]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	program := []string{}
+	if fs.NArg() == 1 {
+		var err error
+		if program, err = getInstructions(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("serving the pipeline viewer on http://%s\n", *addr)
+	return http.ListenAndServe(*addr, newServeMux(program))
+}
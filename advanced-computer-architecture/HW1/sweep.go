@@ -0,0 +1,254 @@
+package main
+
+import (
+	"HW1/processor"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type intList []int
+
+func (l *intList) String() string {
+	values := make([]string, len(*l))
+	for i, v := range *l {
+		values[i] = strconv.Itoa(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *intList) Set(value string) error {
+	*l = nil
+	for _, field := range strings.Split(value, ",") {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, v)
+	}
+	return nil
+}
+
+type boolList []bool
+
+func (l *boolList) String() string {
+	values := make([]string, len(*l))
+	for i, v := range *l {
+		values[i] = strconv.FormatBool(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *boolList) Set(value string) error {
+	*l = nil
+	for _, field := range strings.Split(value, ",") {
+		v, err := strconv.ParseBool(field)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, v)
+	}
+	return nil
+}
+
+type sweepJob struct {
+	program string
+	config  processor.Config
+}
+
+type sweepResult struct {
+	stats processor.Stats
+	err   error
+}
+
+// expand combines every config with every value of a new axis of the grid.
+func expand[T any](configs []processor.Config, values []T, set func(*processor.Config, T)) []processor.Config {
+	expanded := make([]processor.Config, 0, len(configs)*len(values))
+	for _, config := range configs {
+		for _, v := range values {
+			set(&config, v)
+			expanded = append(expanded, config)
+		}
+	}
+	return expanded
+}
+
+type sweepAxes struct {
+	activeList, integerQueue, alus, freeList intList
+	earlyRelease, speculativeWakeup          boolList
+	clusters, clusterDelay                   intList
+	steering                                 processor.Steering
+}
+
+func sweepGrid(programs []string, axes sweepAxes) []sweepJob {
+	configs := []processor.Config{{Steering: axes.steering}}
+	configs = expand(configs, axes.activeList, func(c *processor.Config, v int) { c.ActiveListSize = v })
+	configs = expand(configs, axes.integerQueue, func(c *processor.Config, v int) { c.IntegerQueueSize = v })
+	configs = expand(configs, axes.alus, func(c *processor.Config, v int) { c.ALUs = v })
+	configs = expand(configs, axes.freeList, func(c *processor.Config, v int) { c.FreeListSize = v })
+	configs = expand(configs, axes.earlyRelease, func(c *processor.Config, v bool) { c.EarlyRelease = v })
+	configs = expand(configs, axes.speculativeWakeup, func(c *processor.Config, v bool) { c.SpeculativeWakeup = v })
+	configs = expand(configs, axes.clusters, func(c *processor.Config, v int) { c.Clusters = v })
+	configs = expand(configs, axes.clusterDelay, func(c *processor.Config, v int) { c.ClusterDelay = v })
+
+	var jobs []sweepJob
+	for _, program := range programs {
+		for _, config := range configs {
+			jobs = append(jobs, sweepJob{program: program, config: config})
+		}
+	}
+	return jobs
+}
+
+func runSweepJob(job sweepJob, programs map[string][]string) (processor.Stats, error) {
+	proc, err := processor.NewWithConfig(job.config)
+	if err != nil {
+		return processor.Stats{}, err
+	}
+	// Only the statistics are reported, the workers would otherwise keep every cycle of their program.
+	proc.DisableLog()
+	if err = proc.Load(programs[job.program]); err != nil {
+		return processor.Stats{}, fmt.Errorf("%s: %w", job.program, err)
+	}
+	for !proc.Step() {
+	}
+	return proc.Stats(), nil
+}
+
+func writeSweepCSV(output io.Writer, jobs []sweepJob, results []sweepResult) error {
+	w := csv.NewWriter(output)
+	err := w.Write([]string{
+		"program", "active_list", "integer_queue", "alus", "free_list", "early_release", "speculative_wakeup", "clusters", "cluster_delay", "steering",
+		"cycles", "committed", "ipc", "stalls", "active_list_stalls", "integer_queue_stalls", "free_list_stalls", "early_releases", "replays", "load_misses", "cross_cluster_reads",
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, job := range jobs {
+		s := results[i].stats
+		err = w.Write([]string{
+			job.program,
+			strconv.Itoa(job.config.ActiveListSize),
+			strconv.Itoa(job.config.IntegerQueueSize),
+			strconv.Itoa(job.config.ALUs),
+			strconv.Itoa(job.config.FreeListSize),
+			strconv.FormatBool(job.config.EarlyRelease),
+			strconv.FormatBool(job.config.SpeculativeWakeup),
+			strconv.Itoa(job.config.Clusters),
+			strconv.Itoa(job.config.ClusterDelay),
+			string(job.config.Steering),
+			strconv.FormatUint(s.Cycles, 10),
+			strconv.FormatUint(s.Committed, 10),
+			strconv.FormatFloat(s.IPC(), 'f', 4, 64),
+			strconv.FormatUint(s.Stalls, 10),
+			strconv.FormatUint(s.ActiveListStalls, 10),
+			strconv.FormatUint(s.IntegerQueueStalls, 10),
+			strconv.FormatUint(s.FreeListStalls, 10),
+			strconv.FormatUint(s.EarlyReleases, 10),
+			strconv.FormatUint(s.Replays, 10),
+			strconv.FormatUint(s.LoadMisses, 10),
+			strconv.FormatUint(s.CrossClusterReads, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// runSweep simulates every program with every combination of the parameter grid and writes a CSV report.
+func runSweep(args []string) error {
+	defaults := processor.DefaultConfig()
+	axes := sweepAxes{
+		activeList:        intList{defaults.ActiveListSize},
+		integerQueue:      intList{defaults.IntegerQueueSize},
+		alus:              intList{defaults.ALUs},
+		freeList:          intList{defaults.FreeListSize},
+		earlyRelease:      boolList{defaults.EarlyRelease},
+		speculativeWakeup: boolList{defaults.SpeculativeWakeup},
+		clusters:          intList{defaults.Clusters},
+		clusterDelay:      intList{defaults.ClusterDelay},
+	}
+
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	fs.Var(&axes.activeList, "active-list", "comma separated active list sizes")
+	fs.Var(&axes.integerQueue, "integer-queue", "comma separated integer queue sizes")
+	fs.Var(&axes.alus, "alus", "comma separated ALU counts")
+	fs.Var(&axes.freeList, "free-list", "comma separated free list sizes")
+	fs.Var(&axes.earlyRelease, "early-release", "comma separated register release policies, e.g. false,true to compare both")
+	fs.Var(&axes.speculativeWakeup, "speculative-wakeup", "comma separated wakeup policies, e.g. false,true to compare both")
+	fs.Var(&axes.clusters, "clusters", "comma separated numbers of backend clusters")
+	fs.Var(&axes.clusterDelay, "cluster-delay", "comma separated extra cycles of the values crossing clusters")
+	steering := fs.String("steering", string(defaults.Steering), "steering policy of the clustered backends: round-robin or dependence")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of simulations run concurrently")
+	outPath := fs.String("o", "-", "path of the CSV report, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "./OoO470 sweep [flags] </path/to/input.json>...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *workers < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	programs := make(map[string][]string, fs.NArg())
+	for _, path := range fs.Args() {
+		instructions, err := getInstructions(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		programs[path] = instructions
+	}
+
+	axes.steering = processor.Steering(*steering)
+	jobs := sweepGrid(fs.Args(), axes)
+	results := make([]sweepResult, len(jobs))
+
+	jobIdxs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobIdxs {
+				stats, err := runSweepJob(jobs[i], programs)
+				results[i] = sweepResult{stats: stats, err: err}
+			}
+		}()
+	}
+	for i := range jobs {
+		jobIdxs <- i
+	}
+	close(jobIdxs)
+	wg.Wait()
+
+	for i, res := range results {
+		if res.err != nil {
+			return fmt.Errorf("job %s %+v: %w", jobs[i].program, jobs[i].config, res.err)
+		}
+	}
+
+	output := io.Writer(os.Stdout)
+	if *outPath != "-" {
+		outFile, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer outFile.Close()
+		output = outFile
+	}
+
+	return writeSweepCSV(output, jobs, results)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"HW2/scheduler"
 	"encoding/json"
+	"flag"
 	"io"
 	"log"
 	"os"
@@ -29,29 +30,72 @@ func getInstructions(path string) ([]string, error) {
 	return instructions, nil
 }
 
+// getMachine reads the machine description at path, the VLIW470 of the assignment without one.
+func getMachine(path string) (*scheduler.MachineDescription, error) {
+	if path == "" {
+		return scheduler.VLIW470(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return scheduler.ParseMachineDescription(data)
+}
+
 func main() {
-	if len(os.Args) != 4 {
-		log.Fatalln(os.Args[0] + " </path/to/input.json> </path/to/loop.json> </path/to/looppip.json>")
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := runSimulate(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
 
-	outLoopPipFile, err := os.Create(os.Args[3])
+	verify := flag.Bool("verify", false, "check that the schedules compute the same results as the input program")
+	machinePath := flag.String("machine", "", "machine description, the VLIW470 of the assignment by default")
+	dotPath := flag.String("dot", "", "write the dependency graph of the input program to the path, in Graphviz DOT")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) != 3 {
+		log.Fatalln(os.Args[0] + " [-verify] [-machine </path/to/machine.json>] [-dot </path/to/deps.dot>] </path/to/input.json> </path/to/loop.json> </path/to/looppip.json>")
+	}
+
+	md, err := getMachine(*machinePath)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	outLoopFile, err := os.Create(os.Args[2])
+	outLoopPipFile, err := os.Create(args[2])
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	instructions, err := getInstructions(os.Args[1])
+	outLoopFile, err := os.Create(args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	instructions, err := getInstructions(args[0])
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	sched := scheduler.New()
+	sched.SetMachine(md)
+	sched.SetVerify(*verify)
+	if *dotPath != "" {
+		dotFile, err := os.Create(*dotPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer dotFile.Close()
+		sched.SetDot(dotFile)
+	}
 
 	if err = sched.Schedule(instructions, outLoopFile, outLoopPipFile); err != nil {
 		log.Fatalln(err)
 	}
+	for _, bounds := range sched.LoopBounds() {
+		log.Printf("loop.pip at instruction %d: %s\n", bounds.Loop, bounds)
+	}
 }
@@ -1,22 +1,25 @@
 package scheduler
 
 type blockScheduler struct {
+	md         *MachineDescription
 	instrs     []instruction
 	deps       sectionDeps
 	pcToBundle []int
 }
 
-func (bs *blockScheduler) scheduleBlockWithoutInterloopDeps(bundles *blockBundles, deps []dependency, blockStartIdx int) *blockBundles {
+func (bs *blockScheduler) scheduleBlockWithoutInterloopDeps(bundles *blockBundles, deps []dependency, block *[]bundle) *blockBundles {
+	blockStartIdx := bundles.startOf(block)
 	for _, dep := range deps {
 		// Check deps.
 		minDepIdx := blockStartIdx
 		for _, depPc := range dep.nonInterloopBodyDeps() {
 			bDep := bs.pcToBundle[depPc]
-			latency := bs.instrs[depPc].latency()
+			latency := bs.md.latency(bs.instrs[depPc])
 
 			earliestTime := bDep + latency
 			minDepIdx = maxInt(minDepIdx, earliestTime)
 		}
+		minDepIdx = maxInt(minDepIdx, bs.earliestAfterMemoryDeps(dep))
 
 		sI := &specIns{
 			pred:  nil,
@@ -27,9 +30,9 @@ func (bs *blockScheduler) scheduleBlockWithoutInterloopDeps(bundles *blockBundle
 		idx := minDepIdx
 		for {
 			// Extend slice if needed.
-			bundles.extend(blockStartIdx, idx+1)
+			bundles.extend(block, idx+1)
 
-			if bundles.get(idx).addInst(sI) != noSlot {
+			if bundles.get(idx).addInst(bs.md, sI) != noSlot {
 				bs.pcToBundle[dep.pc] = idx
 				break
 			}
@@ -39,13 +42,23 @@ func (bs *blockScheduler) scheduleBlockWithoutInterloopDeps(bundles *blockBundle
 	return bundles
 }
 
+// earliestAfterMemoryDeps returns the first bundle the load or store can be placed in after the earlier accesses
+// of its address.
+func (bs *blockScheduler) earliestAfterMemoryDeps(dep dependency) int {
+	earliest := 0
+	for _, depPc := range dep.memoryDeps {
+		earliest = maxInt(earliest, bs.pcToBundle[depPc]+bs.md.memoryLatency(bs.instrs[depPc], bs.instrs[dep.pc]))
+	}
+	return earliest
+}
+
 func (bs *blockScheduler) removePreLoopBubble(bundles *blockBundles) *blockBundles {
 	bubbleSize := 0
 	for idx := bundles.bb1Start(); idx < bundles.len() && bundles.get(idx).empty(); idx++ {
 		bubbleSize++
 	}
-	bundles.extendBlockBy(bundles.bb0Start(), bubbleSize)
-	bundles.trimStart(bundles.bb1Start(), bubbleSize)
+	bundles.extendBlockBy(&bundles.bb0, bubbleSize)
+	bundles.trimStart(&bundles.bb1, bubbleSize)
 
 	return bundles
 }
@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SetDot sets where Schedule writes the dependency graph of the program in the DOT language of Graphviz, nil to
+// not write it.
+func (s *Scheduler) SetDot(w io.Writer) {
+	s.dot = w
+}
+
+// Edge attributes by kind of dependency.
+const (
+	localDepStyle         = ""
+	interloopDepStyle     = `, style=bold, color=red, constraint=false`
+	interloopInitDepStyle = `, color=red, fontcolor=red`
+	loopInvariantDepStyle = `, style=dashed`
+	postLoopDepStyle      = `, style=dotted`
+	memoryDepStyle        = `, color=blue, fontcolor=blue`
+	interloopMemDepStyle  = `, style=bold, color=blue, fontcolor=blue, constraint=false`
+)
+
+// dotEdge is an edge of the dependency graph, from the producer to the consumer.
+type dotEdge struct {
+	from, to int
+	label    string
+	style    string
+}
+
+// writeDot writes the dependency graph, the instructions are the nodes and every region of the program a cluster.
+// The top level regions are bb0, bb1 and so on, the ones of the body of an outer loop are numbered under the loop.
+// The edges are labelled with the register and the latency of the dependency.
+func writeDot(w io.Writer, md *MachineDescription, instrs []instruction, deps sectionDeps) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "digraph dependencies {")
+	fmt.Fprintln(out, `	node [shape=box, fontname="monospace"];`)
+	writeDotClusters(out, instrs, deps.regions, "bb", "\t")
+	for _, e := range dotEdges(md, instrs, deps) {
+		fmt.Fprintf(out, "\ti%d -> i%d [label=%q%s];\n", e.from, e.to, e.label, e.style)
+	}
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+func writeDotClusters(out io.Writer, instrs []instruction, regions []region, prefix string, indent string) {
+	for i, r := range regions {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		fmt.Fprintf(out, "%ssubgraph \"cluster_%s\" {\n", indent, name)
+		fmt.Fprintf(out, "%s\tlabel=%q;\n", indent, name)
+		first := r.start
+		if r.loop && !r.innermost() {
+			// The body is the regions before the loop instruction.
+			writeDotClusters(out, instrs, r.body, name+".", indent+"\t")
+			first = r.end - 1
+		}
+		for pc := first; pc < r.end; pc++ {
+			writeDotNode(out, instrs[pc], indent+"\t")
+		}
+		fmt.Fprintf(out, "%s}\n", indent)
+	}
+}
+
+func writeDotNode(out io.Writer, instr instruction, indent string) {
+	fmt.Fprintf(out, "%si%d [label=%q];\n", indent, instr.pc, fmt.Sprintf("%d: %s", instr.pc, instr))
+}
+
+// dotEdges returns the edges of the dependencies in a stable order. An interloop dependency has an edge from the
+// value before the loop, labelled init, and one from the previous iteration. A register carried in from before
+// the program only has the one from the previous iteration.
+func dotEdges(md *MachineDescription, instrs []instruction, deps sectionDeps) []dotEdge {
+	var edges []dotEdge
+	regEdge := func(from, to int, r reg, style string) {
+		edges = append(edges, dotEdge{from: from, to: to, label: fmt.Sprintf("%s, %d", r, md.latency(instrs[from])), style: style})
+	}
+
+	for _, dep := range deps.deps {
+		for r, depPc := range dep.localDeps {
+			regEdge(depPc, dep.pc, r, localDepStyle)
+		}
+		for r, iDep := range dep.interloopDeps {
+			label := fmt.Sprintf("%s, %d, init", r, md.latency(instrs[iDep.init]))
+			edges = append(edges, dotEdge{from: iDep.init, to: dep.pc, label: label, style: interloopInitDepStyle})
+			regEdge(iDep.body, dep.pc, r, interloopDepStyle)
+		}
+		for r, depPc := range dep.loopInvariantDeps {
+			regEdge(depPc, dep.pc, r, loopInvariantDepStyle)
+		}
+		for r, depPc := range dep.postLoopDeps {
+			regEdge(depPc, dep.pc, r, postLoopDepStyle)
+		}
+
+		for _, depPc := range dep.memoryDeps {
+			latency := md.memoryLatency(instrs[depPc], instrs[dep.pc])
+			edges = append(edges, dotEdge{from: depPc, to: dep.pc, label: fmt.Sprintf("mem, %d", latency), style: memoryDepStyle})
+		}
+		for _, mDep := range dep.interloopMemoryDeps {
+			latency := md.memoryLatency(instrs[mDep.pc], instrs[dep.pc])
+			label := fmt.Sprintf("mem, %d, distance %d", latency, mDep.distance)
+			edges = append(edges, dotEdge{from: mDep.pc, to: dep.pc, label: label, style: interloopMemDepStyle})
+		}
+	}
+
+	for _, read := range deps.carriedOnly {
+		regEdge(read.body, read.pc, read.r, interloopDepStyle)
+	}
+
+	sort.SliceStable(edges, func(i, j int) bool {
+		if edges[i].to != edges[j].to {
+			return edges[i].to < edges[j].to
+		}
+		if edges[i].from != edges[j].from {
+			return edges[i].from < edges[j].from
+		}
+		return edges[i].label < edges[j].label
+	})
+	return edges
+}
@@ -1,12 +1,15 @@
 package scheduler
 
+import "fmt"
+
 type loopScheduler struct {
 	blockScheduler
 }
 
-func newLoopScheduler(instrs []instruction, deps sectionDeps) *loopScheduler {
+func newLoopScheduler(md *MachineDescription, instrs []instruction, deps sectionDeps) *loopScheduler {
 	return &loopScheduler{
 		blockScheduler{
+			md:         md,
 			instrs:     instrs,
 			deps:       deps,
 			pcToBundle: make([]int, len(instrs)),
@@ -14,19 +17,28 @@ func newLoopScheduler(instrs []instruction, deps sectionDeps) *loopScheduler {
 	}
 }
 
-func (ls *loopScheduler) schedule() *blockBundles {
-	bundles := ls.doSchedule()
-	return ls.allocateRegister(bundles)
+func (ls *loopScheduler) schedule() (*blockBundles, error) {
+	bundles := ls.allocateRegister(ls.doSchedule())
+	// The registers are reused once their value is dead, by the liveness over the final bundles.
+	if !bundles.assignRegisters(ls.md.Registers.size()) {
+		return nil, fmt.Errorf("loop needs more than the %d registers of the machine", ls.md.Registers.size())
+	}
+	return bundles, nil
+}
+
+// scheduleSection schedules the instructions as a section of a program, with virtual registers.
+func (ls *loopScheduler) scheduleSection() (*blockBundles, error) {
+	return ls.allocateRegister(ls.doSchedule()), nil
 }
 
 func (ls *loopScheduler) doSchedule() *blockBundles {
-	bundles := ls.doScheduleBB0(new(blockBundles))
+	bundles := ls.doScheduleBB0(&blockBundles{md: ls.md})
 	bundles = ls.doScheduleBB1(bundles)
 	return ls.doScheduleBB2(bundles)
 }
 
 func (ls *loopScheduler) doScheduleBB0(bundles *blockBundles) *blockBundles {
-	return ls.scheduleBlockWithoutInterloopDeps(bundles, ls.deps.bb0(), bundles.bb0Start())
+	return ls.scheduleBlockWithoutInterloopDeps(bundles, ls.deps.bb0(), &bundles.bb0)
 }
 
 func (ls *loopScheduler) doScheduleBB1(bundles *blockBundles) *blockBundles {
@@ -36,7 +48,7 @@ func (ls *loopScheduler) doScheduleBB1(bundles *blockBundles) *blockBundles {
 	}
 
 	bb1NoLoop, bb1Loop := bb1[:len(bb1)-1], bb1[len(bb1)-1]
-	bundles = ls.scheduleBlockWithoutInterloopDeps(bundles, bb1NoLoop, bundles.bb1Start())
+	bundles = ls.scheduleBlockWithoutInterloopDeps(bundles, bb1NoLoop, &bundles.bb1)
 
 	bundles = ls.removePreLoopBubble(bundles)
 
@@ -44,10 +56,10 @@ func (ls *loopScheduler) doScheduleBB1(bundles *blockBundles) *blockBundles {
 	neededII := ls.getNeededII()
 
 	loopNeededIdx := bundles.bb1Start() + neededII - 1
-	bundles.extend(bundles.bb1Start(), loopNeededIdx+1)
+	bundles.extend(&bundles.bb1, loopNeededIdx+1)
 
 	loopIdx := bundles.len() - 1
-	bundles.get(loopIdx)[branch] = &specIns{
+	bundles.get(loopIdx)[ls.md.branch] = &specIns{
 		pred: nil,
 		instr: instruction{
 			pc:    bb1Loop.pc,
@@ -68,31 +80,40 @@ func (ls *loopScheduler) getNeededII() int {
 
 		for _, iDep := range dep.interloopDeps {
 			depPc := iDep.body
-			latency := ls.instrs[depPc].latency()
+			latency := ls.md.latency(ls.instrs[depPc])
 			depBundle := ls.pcToBundle[depPc]
 
 			depNeededII := depBundle + latency - currBundle
 			neededII = maxInt(neededII, depNeededII)
 		}
+
+		for _, mDep := range dep.interloopMemoryDeps {
+			latency := ls.md.memoryLatency(ls.instrs[mDep.pc], ls.instrs[dep.pc])
+			depBundle := ls.pcToBundle[mDep.pc]
+
+			// The access of distance iterations later starts distance times II bundles later.
+			depNeededII := (depBundle + latency - currBundle + mDep.distance - 1) / mDep.distance
+			neededII = maxInt(neededII, depNeededII)
+		}
 	}
 
 	return neededII
 }
 
 func (ls *loopScheduler) doScheduleBB2(bundles *blockBundles) *blockBundles {
-	return ls.scheduleBlockWithoutInterloopDeps(bundles, ls.deps.bb2(), bundles.bb2Start())
+	return ls.scheduleBlockWithoutInterloopDeps(bundles, ls.deps.bb2(), &bundles.bb2)
 }
 
+// allocateRegister gives the values virtual registers, assignRegisters maps them to the registers of the machine.
 func (ls *loopScheduler) allocateRegister(bundles *blockBundles) *blockBundles {
-	currRegNum := uint8(1)
+	currRegNum := virtualReg
 
 	instrs := ls.gatherInstrs(bundles)
 
 	bundles, currRegNum = ls.allocateRegisterPhase1(bundles, currRegNum)
 	ls.allocateRegisterPhase2(instrs)
 	bundles = ls.allocateRegisterPhase3(bundles, instrs)
-	bundles, _ = ls.allocateRegisterPhase4(bundles, currRegNum)
-	return bundles
+	return ls.allocateRegisterPhase4(bundles, currRegNum)
 }
 
 func (ls *loopScheduler) gatherInstrs(bundles *blockBundles) []*instruction {
@@ -108,7 +129,7 @@ func (ls *loopScheduler) gatherInstrs(bundles *blockBundles) []*instruction {
 	return instrs
 }
 
-func (ls *loopScheduler) allocateRegisterPhase1(bundles *blockBundles, currRegNum uint8) (*blockBundles, uint8) {
+func (ls *loopScheduler) allocateRegisterPhase1(bundles *blockBundles, currRegNum int) (*blockBundles, int) {
 	for i := 0; i < bundles.len(); i++ {
 		for _, sI := range bundles.get(i) {
 			if sI != nil {
@@ -128,9 +149,11 @@ func (ls *loopScheduler) allocateRegisterPhase2(instrs []*instruction) {
 		instr := instrs[i]
 
 		_, ops := instr.mutRegs()
+		// Match the operands of the input, the renamed ones may collide with other registers of the input.
+		_, inputOps := ls.instrs[i].regs()
 		for r, depPc := range dep.nonInterloopBodyDeps() {
-			for _, op := range ops {
-				if *op == r {
+			for j, op := range ops {
+				if inputOps[j] == r {
 					dst, _ := instrs[depPc].regs()
 					*op = *dst
 				}
@@ -171,27 +194,27 @@ func (ls *loopScheduler) allocateRegisterPhase3(bundles *blockBundles, instrs []
 				},
 			}
 
-			fixUpBundleIdx := ls.pcToBundle[bb1DepPc] + bb1DepInstr.latency()
+			fixUpBundleIdx := ls.pcToBundle[bb1DepPc] + ls.md.latency(*bb1DepInstr)
 
 			// Try to insert at last possible spot.
 			// TODO: what is a last possible spot? Is it last bundle of the loop, or last viable bundle?
 			if fixUpBundleIdx <= loopBundleIdx {
-				if bundles.get(loopBundleIdx).addInst(sI) == noSlot {
+				if bundles.get(loopBundleIdx).addInst(ls.md, sI) == noSlot {
 					fixUpBundleIdx = loopBundleIdx + 1
 				}
 			}
 
 			// More space for bb1 is needed.
 			if fixUpBundleIdx > loopBundleIdx {
-				bundles.extendBlockBy(bundles.bb1Start(), fixUpBundleIdx-loopBundleIdx)
+				bundles.extendBlockBy(&bundles.bb1, fixUpBundleIdx-loopBundleIdx)
 
 				loopBundle := bundles.get(loopBundleIdx)
-				*bundles.get(fixUpBundleIdx) = bundle{
-					alu1:   sI,
-					branch: loopBundle[branch],
-				}
+				fixUpBundle := bundles.get(fixUpBundleIdx)
+				*fixUpBundle = bundle{}
+				fixUpBundle.addInst(ls.md, sI)
+				fixUpBundle[ls.md.branch] = loopBundle[ls.md.branch]
 				// Remove old branch instruction
-				loopBundle[branch] = nil
+				loopBundle[ls.md.branch] = nil
 
 				loopBundleIdx = fixUpBundleIdx
 			}
@@ -201,29 +224,23 @@ func (ls *loopScheduler) allocateRegisterPhase3(bundles *blockBundles, instrs []
 	return bundles
 }
 
-func (ls *loopScheduler) allocateRegisterPhase4(bundles *blockBundles, currRegNum uint8) (*blockBundles, uint8) {
-	wroteTo := make(map[reg]bool)
+func (ls *loopScheduler) allocateRegisterPhase4(bundles *blockBundles, currRegNum int) *blockBundles {
 	for i := 0; i < bundles.len(); i++ {
-		bundleWroteTo := make(map[reg]bool)
 		for _, sI := range bundles.get(i) {
-			if sI != nil {
-				dst, ops := sI.instr.mutRegs()
-				if dst != nil {
-					bundleWroteTo[*dst] = true
-				}
-				for _, op := range ops {
-					if op.type_ == xReg && !wroteTo[*op] {
+			if sI != nil && sI.instr.pc != -1 {
+				_, ops := sI.instr.mutRegs()
+				// The renamed operands may collide with the registers of the input, check the input ones.
+				_, inputOps := ls.instrs[sI.instr.pc].regs()
+				dep := ls.deps.deps[sI.instr.pc]
+				for j, op := range ops {
+					if op.type_ == xReg && !dep.dependsOn(inputOps[j]) {
 						op.num = currRegNum
 						currRegNum++
 					}
 				}
 			}
 		}
-
-		for r := range bundleWroteTo {
-			wroteTo[r] = true
-		}
 	}
 
-	return bundles, currRegNum
+	return bundles
 }
@@ -1,14 +1,21 @@
 package scheduler
 
+import "fmt"
+
 type loopPipScheduler struct {
 	blockScheduler
 	dstAllocated []bool
 	opAllocated  [][2]bool
+	bounds       LoopBounds
+	// clearPredicates sets the predicates of the stages after the first to false before the loop, an earlier loop
+	// may have left them true.
+	clearPredicates bool
 }
 
-func newLoopPipScheduler(instrs []instruction, deps sectionDeps) *loopPipScheduler {
+func newLoopPipScheduler(md *MachineDescription, instrs []instruction, deps sectionDeps) *loopPipScheduler {
 	return &loopPipScheduler{
 		blockScheduler: blockScheduler{
+			md:         md,
 			instrs:     instrs,
 			deps:       deps,
 			pcToBundle: make([]int, len(instrs)),
@@ -18,21 +25,64 @@ func newLoopPipScheduler(instrs []instruction, deps sectionDeps) *loopPipSchedul
 	}
 }
 
-func (lps *loopPipScheduler) schedule() *blockBundles {
+func (lps *loopPipScheduler) schedule() (*blockBundles, error) {
+	bundles, II := lps.doSchedule()
+	if err := lps.checkPredicates(bundles, II); err != nil {
+		return nil, err
+	}
+
+	if allocated, ok := lps.allocateRegister(bundles.clone(), II, false); ok {
+		return lps.prepLoop(allocated, II), nil
+	}
+
+	// Too many registers, pack the rotating ones by lifetime and reuse the static ones once they are dead.
+	lps.dstAllocated = make([]bool, len(lps.instrs))
+	lps.opAllocated = make([][2]bool, len(lps.instrs))
+	allocated, err := lps.allocateVirtual(bundles, II)
+	if err != nil {
+		return nil, err
+	}
+	if !allocated.assignRegisters(lps.md.Registers.Static) {
+		return nil, fmt.Errorf("loop.pip needs more than the %d static registers of the machine", lps.md.Registers.Static)
+	}
+	return allocated, nil
+}
+
+// scheduleSection schedules the instructions as a section of a program, with virtual static registers.
+func (lps *loopPipScheduler) scheduleSection() (*blockBundles, error) {
 	bundles, II := lps.doSchedule()
-	bundles = lps.allocateRegister(bundles, II)
-	return lps.prepLoop(bundles, II)
+	if err := lps.checkPredicates(bundles, II); err != nil {
+		return nil, err
+	}
+	return lps.allocateVirtual(bundles, II)
+}
+
+func (lps *loopPipScheduler) checkPredicates(bundles *blockBundles, II int) error {
+	if len(bundles.bb1) != 0 && loopStages(bundles, II) > lps.md.Predicates.Rotating {
+		return fmt.Errorf("loop.pip needs %d rotating predicates, the machine has %d",
+			loopStages(bundles, II), lps.md.Predicates.Rotating)
+	}
+	return nil
+}
+
+// allocateVirtual packs the rotating registers and names the static ones virtually, for assignRegisters.
+func (lps *loopPipScheduler) allocateVirtual(bundles *blockBundles, II int) (*blockBundles, error) {
+	allocated, ok := lps.allocateRegister(bundles, II, true)
+	if !ok {
+		return nil, fmt.Errorf("loop.pip needs more than the %d rotating registers of the machine", lps.md.Registers.Rotating)
+	}
+	return lps.prepLoop(allocated, II), nil
 }
 
 func (lps *loopPipScheduler) doSchedule() (*blockBundles, int) {
-	bundles := lps.doScheduleBB0(new(blockBundles))
+	bundles := lps.doScheduleBB0(&blockBundles{md: lps.md})
 	bundles, II := lps.doScheduleBB1(bundles)
 	bundles = lps.doScheduleBB2(bundles)
 	return bundles, II
 }
 
 func (lps *loopPipScheduler) doScheduleBB0(bundles *blockBundles) *blockBundles {
-	return lps.scheduleBlockWithoutInterloopDeps(bundles, lps.deps.bb0(), bundles.bb0Start())
+	return lps.scheduleBlockWithoutInterloopDeps(bundles, lps.deps.bb0(), &bundles.bb0)
 }
 
 func (lps *loopPipScheduler) doScheduleBB1(bundles *blockBundles) (*blockBundles, int) {
@@ -40,48 +90,130 @@ func (lps *loopPipScheduler) doScheduleBB1(bundles *blockBundles) (*blockBundles
 		return bundles, 0
 	}
 
-	II := lps.getMinII(lps.deps.bb1())
+	bb1 := lps.deps.bb1()
+	ops := make([]int, len(bb1)-1)
+	for i, dep := range bb1[:len(bb1)-1] {
+		ops[i] = dep.pc
+	}
+	lps.bounds.ResMII = lps.getMinII(bb1)
+	lps.bounds.RecMII = recMII(ops, lps.bodyEdges(bb1[:len(bb1)-1]))
+
+	II := maxInt(lps.bounds.ResMII, lps.bounds.RecMII)
+	bb0Length := len(bundles.bb0)
 
 	for {
-		var ok bool
-		bundles, ok = lps.tryScheduleBB1(bundles, II)
-		if ok && lps.checkInterLoopDeps(bundles.bb1Start(), II) {
-			return bundles, II
+		for _, try := range []func(*blockBundles, int) (*blockBundles, bool){lps.tryScheduleBB1, lps.tryScheduleBB1InOrder} {
+			var ok bool
+			bundles, ok = try(bundles, II)
+			if ok && lps.checkInterLoopDeps(bundles.bb1Start(), II) {
+				lps.bounds.II = II
+				return bundles, II
+			}
+			// Undo the removal of the bubble.
+			bundles.bb0 = bundles.bb0[:bb0Length]
+			bundles.bb1 = nil
 		}
-		bundles.bb1 = nil
 		II++
 	}
 }
 
 func (lps *loopPipScheduler) getMinII(deps []dependency) int {
-	var aluCounter, mulCounter, memCounter, branchCounter int
+	// Instructions by unit, a unit is known by its first slot.
+	counters := make(map[bundleSlot]int)
+	for _, dep := range deps {
+		counters[lps.md.slotsOf(lps.instrs[dep.pc].type_)[0]]++
+	}
 
+	minII := 0
 	for _, dep := range deps {
-		instr := lps.instrs[dep.pc]
-		if instr.type_.isMem() {
-			memCounter++
-		} else if instr.type_.isAlu() {
-			aluCounter++
-		} else if instr.type_.isMul() {
-			mulCounter++
-		} else if instr.type_.isBranch() {
-			branchCounter++
+		slots := lps.md.slotsOf(lps.instrs[dep.pc].type_)
+		// We need a ceil.
+		minII = maxInt(minII, (counters[slots[0]]+len(slots)-1)/len(slots))
+	}
+	return minII
+}
+
+func (lps *loopPipScheduler) tryScheduleBB1(bundles *blockBundles, II int) (*blockBundles, bool) {
+	depsBB1 := lps.deps.bb1()
+	if len(depsBB1) == 0 {
+		return bundles, true
+	}
+
+	loopDep := depsBB1[len(depsBB1)-1]
+	body := depsBB1[:len(depsBB1)-1]
+
+	// The values and the stores coming from bb0 bound the start of the instructions.
+	earliest := func(pc int) int {
+		minDepIdx := 0
+		for _, depPc := range lps.deps.deps[pc].nonInterloopBodyDeps() {
+			if depPc < lps.deps.bb1Start {
+				minDepIdx = maxInt(minDepIdx, lps.pcToBundle[depPc]+lps.md.latency(lps.instrs[depPc])-bundles.bb1Start())
+			}
 		}
+		for _, depPc := range lps.deps.deps[pc].memoryDeps {
+			if depPc < lps.deps.bb1Start {
+				minDepIdx = maxInt(minDepIdx, lps.pcToBundle[depPc]+lps.md.memoryLatency(lps.instrs[depPc], lps.instrs[pc])-bundles.bb1Start())
+			}
+		}
+		return minDepIdx
+	}
+	times, slots, ok := lps.moduloSchedule(body, earliest, II)
+	if !ok {
+		return bundles, false
 	}
-	// There are two ALU units and we need a ceil.
-	aluScore := (aluCounter + 1) / 2
 
-	return maxInt(aluScore, mulCounter, memCounter, branchCounter)
+	// Lay the iteration out, with space for the loop after a potential bubble.
+	maxTime := -1
+	for _, t := range times {
+		maxTime = maxInt(maxTime, t)
+	}
+	bundles.bb1 = make([]bundle, maxTime+1+II)
+	for _, dep := range body {
+		t := times[dep.pc]
+		bundles.bb1[t][slots[dep.pc]] = &specIns{
+			pred:  nil,
+			instr: lps.instrs[dep.pc],
+		}
+		lps.pcToBundle[dep.pc] = bundles.bb1Start() + t
+	}
+	maxAssignedIdx := bundles.bb1Start() + maxTime
+
+	// Remove bubble.
+	// Check for empty loop case.
+	if maxAssignedIdx >= bundles.bb1Start() {
+		bundles = lps.removePreLoopBubble(bundles)
+	}
+
+	// Add loop.
+	loopBundle := bundles.bb1Start() + II - 1
+	bundles.get(loopBundle)[lps.md.branch] = &specIns{
+		pred: nil,
+		instr: instruction{
+			pc:    loopDep.pc,
+			type_: loopPip,
+			imm:   int64(bundles.bb1Start()),
+		},
+	}
+	lps.pcToBundle[loopDep.pc] = loopBundle
+	maxAssignedIdx = maxInt(maxAssignedIdx, loopBundle)
+
+	// Shrink bb1 size.
+	blockLength := maxAssignedIdx + 1 - bundles.bb1Start()
+	bundles.shrinkBlock(&bundles.bb1, blockLength)
+
+	return bundles, true
 }
 
-func (lps *loopPipScheduler) tryScheduleBB1(bundles *blockBundles, II int) (*blockBundles, bool) {
+// tryScheduleBB1InOrder places the instructions greedily in program order, it sometimes finds a schedule
+// the modulo scheduler misses.
+func (lps *loopPipScheduler) tryScheduleBB1InOrder(bundles *blockBundles, II int) (*blockBundles, bool) {
 	depsBB1 := lps.deps.bb1()
 	if len(depsBB1) == 0 {
 		return bundles, true
 	}
 
 	// Allocate memory for new bundles.
-	maxNewBundles := II*5 + 3 // There are 2 ALU slots, 1 Mult, 1 Mem and 1 branch slot in each bundle, 3 for potential bubble.
+	maxNewBundles := II*lps.md.numSlots + 3 // Every slot of each bundle filled, 3 for potential bubble.
 	bundles.bb1 = make([]bundle, maxNewBundles)
 
 	maxAssignedIdx := bundles.bb1Start() - 1
@@ -92,11 +224,12 @@ func (lps *loopPipScheduler) tryScheduleBB1(bundles *blockBundles, II int) (*blo
 		minDepIdx := bundles.bb1Start()
 		for _, depPc := range dep.nonInterloopBodyDeps() {
 			bDep := lps.pcToBundle[depPc]
-			latency := lps.instrs[depPc].latency()
+			latency := lps.md.latency(lps.instrs[depPc])
 
 			earliestTime := bDep + latency
 			minDepIdx = maxInt(minDepIdx, earliestTime)
 		}
+		minDepIdx = maxInt(minDepIdx, lps.earliestAfterMemoryDeps(dep))
 
 		sI := &specIns{
 			pred:  nil,
@@ -107,7 +240,7 @@ func (lps *loopPipScheduler) tryScheduleBB1(bundles *blockBundles, II int) (*blo
 		i := minDepIdx
 		slot := noSlot
 		for i < bundles.len() {
-			slot = bundles.get(i).addInst(sI)
+			slot = bundles.get(i).addInst(lps.md, sI)
 			if slot != noSlot {
 				lps.pcToBundle[dep.pc] = i
 				break
@@ -134,7 +267,7 @@ func (lps *loopPipScheduler) tryScheduleBB1(bundles *blockBundles, II int) (*blo
 
 	// Add loop.
 	loopBundle := bundles.bb1Start() + II - 1
-	bundles.get(loopBundle)[branch] = &specIns{
+	bundles.get(loopBundle)[lps.md.branch] = &specIns{
 		pred: nil,
 		instr: instruction{
 			pc:    loopDep.pc,
@@ -147,7 +280,7 @@ func (lps *loopPipScheduler) tryScheduleBB1(bundles *blockBundles, II int) (*blo
 
 	// Shrink bb1 size.
 	blockLength := maxAssignedIdx + 1 - bundles.bb1Start()
-	bundles.shrinkBlock(bundles.bb1Start(), blockLength)
+	bundles.shrinkBlock(&bundles.bb1, blockLength)
 
 	return bundles, true
 }
@@ -155,16 +288,21 @@ func (lps *loopPipScheduler) tryScheduleBB1(bundles *blockBundles, II int) (*blo
 func (lps *loopPipScheduler) checkInterLoopDeps(bb1StartIdx int, II int) bool {
 	for _, dep := range lps.deps.bb1() {
 		currBundle := lps.pcToBundle[dep.pc]
-		inStageCurrIdx := (currBundle - bb1StartIdx) % II
 
 		for _, iDep := range dep.interloopDeps {
 			depPc := iDep.body
-			latency := lps.instrs[depPc].latency()
+			latency := lps.md.latency(lps.instrs[depPc])
 			depBundle := lps.pcToBundle[depPc]
 
-			inStageDepIdx := (depBundle - bb1StartIdx) % II
+			// The producer of the previous iteration started II bundles earlier.
+			if depBundle+latency > II+currBundle {
+				return false
+			}
+		}
 
-			if inStageDepIdx+latency > II+inStageCurrIdx {
+		for _, mDep := range dep.interloopMemoryDeps {
+			latency := lps.md.memoryLatency(lps.instrs[mDep.pc], lps.instrs[dep.pc])
+			if lps.pcToBundle[mDep.pc]+latency > II*mDep.distance+currBundle {
 				return false
 			}
 		}
@@ -173,23 +311,33 @@ func (lps *loopPipScheduler) checkInterLoopDeps(bb1StartIdx int, II int) bool {
 }
 
 func (lps *loopPipScheduler) doScheduleBB2(bundles *blockBundles) *blockBundles {
-	return lps.scheduleBlockWithoutInterloopDeps(bundles, lps.deps.bb2(), bundles.bb2Start())
+	return lps.scheduleBlockWithoutInterloopDeps(bundles, lps.deps.bb2(), &bundles.bb2)
 }
 
-func (lps *loopPipScheduler) allocateRegister(bundles *blockBundles, II int) *blockBundles {
-	currStaticRegNum := uint8(1)
-	currRotRegNum := uint8(32)
+// allocateRegister names the registers, it reports whether they fit the register file. To reuse the registers,
+// the rotating ones are packed by lifetime and the static ones are virtual, left for assignRegisters.
+func (lps *loopPipScheduler) allocateRegister(bundles *blockBundles, II int, reuse bool) (*blockBundles, bool) {
+	currStaticRegNum := 1
+	if reuse {
+		currStaticRegNum = virtualReg
+	}
+	currRotRegNum := lps.md.firstRotatingReg()
 
 	instrs := lps.gatherInstrs(bundles)
 
-	currRotRegNum = lps.allocateRegisterPhase1(bundles, currRotRegNum, II)
+	currRotRegNum = lps.allocateRegisterPhase1(bundles, currRotRegNum, II, reuse)
 	currStaticRegNum = lps.allocateRegisterPhase2(bundles, instrs, currStaticRegNum)
 	lps.allocateRegisterPhase3(bundles, instrs, II)
 	currStaticRegNum = lps.allocateRegisterPhase4(bundles, instrs, currStaticRegNum, II)
 
-	_, _ = currStaticRegNum, instrs
-
-	return bundles
+	fits := currRotRegNum <= lps.md.Registers.size() && (reuse || currStaticRegNum <= lps.md.Registers.Static)
+	// The initial values of the interloop dependencies are named before the rotating registers of their stage.
+	for _, dep := range lps.deps.bb1() {
+		for _, iDep := range dep.interloopDeps {
+			fits = fits && instrs[iDep.init].regA.num >= lps.md.firstRotatingReg()
+		}
+	}
+	return bundles, fits
 }
 
 func (lps *loopPipScheduler) gatherInstrs(bundles *blockBundles) []*instruction {
@@ -205,19 +353,25 @@ func (lps *loopPipScheduler) gatherInstrs(bundles *blockBundles) []*instruction
 	return instrs
 }
 
-func (lps *loopPipScheduler) allocateRegisterPhase1(bundles *blockBundles, currRotRegNum uint8, II int) uint8 {
+func (lps *loopPipScheduler) allocateRegisterPhase1(bundles *blockBundles, currRotRegNum int, II int, pack bool) int {
 	if len(bundles.bb1) == 0 {
 		return currRotRegNum
 	}
-	numStages := uint8(loopStages(bundles, II))
+	numStages := loopStages(bundles, II)
+	below, above := lps.rotatingLifetimes(bundles, II)
 
 	for _, b := range bundles.bb1 {
 		for _, sI := range b {
 			if sI != nil && sI.instr.pc != -1 {
 				dst, _ := sI.instr.mutRegs()
 				if dst != nil && dst.type_ == xReg {
-					dst.num = currRotRegNum
-					currRotRegNum += numStages + 1
+					if pack {
+						dst.num = currRotRegNum + below[sI.instr.pc]
+						currRotRegNum += below[sI.instr.pc] + above[sI.instr.pc] + 1
+					} else {
+						dst.num = currRotRegNum
+						currRotRegNum += numStages + 1
+					}
 
 					lps.dstAllocated[sI.instr.pc] = true
 				}
@@ -227,7 +381,34 @@ func (lps *loopPipScheduler) allocateRegisterPhase1(bundles *blockBundles, currR
 	return currRotRegNum
 }
 
-func (lps *loopPipScheduler) allocateRegisterPhase2(bundles *blockBundles, instrs []*instruction, currStaticRegNum uint8) uint8 {
+// rotatingLifetimes returns, for the instructions of the loop, the rotating registers their values need under
+// and over the one they are written to. The value of an iteration lands or is read up to above stages later, and
+// the initial value of an interloop dependency is written before the loop, below the register.
+func (lps *loopPipScheduler) rotatingLifetimes(bundles *blockBundles, II int) (below, above map[int]int) {
+	below, above = make(map[int]int), make(map[int]int)
+	for _, dep := range lps.deps.bb1() {
+		stage := lps.loopStage(bundles, dep.pc, II)
+		landing := lps.pcToBundle[dep.pc] + lps.md.latency(lps.instrs[dep.pc]) - bundles.bb1Start()
+		above[dep.pc] = maxInt(above[dep.pc], landing/II-stage)
+		for _, depPc := range dep.localDeps {
+			above[depPc] = maxInt(above[depPc], stage-lps.loopStage(bundles, depPc, II))
+		}
+		for _, iDep := range dep.interloopDeps {
+			depStage := lps.loopStage(bundles, iDep.body, II)
+			above[iDep.body] = maxInt(above[iDep.body], stage-depStage+1)
+			below[iDep.body] = maxInt(below[iDep.body], depStage-1)
+		}
+	}
+	lastStage := loopStages(bundles, II) - 1
+	for _, dep := range lps.deps.bb2() {
+		for _, depPc := range dep.postLoopDeps {
+			above[depPc] = maxInt(above[depPc], lastStage-lps.loopStage(bundles, depPc, II))
+		}
+	}
+	return below, above
+}
+
+func (lps *loopPipScheduler) allocateRegisterPhase2(bundles *blockBundles, instrs []*instruction, currStaticRegNum int) int {
 	for _, b := range bundles.bb1 {
 		for _, sI := range b {
 			if sI != nil && sI.instr.pc != -1 {
@@ -256,11 +437,12 @@ func (lps *loopPipScheduler) allocateRegisterPhase3(bundles *blockBundles, instr
 				instr := instrs[sI.instr.pc]
 				dep := lps.deps.deps[sI.instr.pc]
 				_, ops := instr.mutRegs()
+				_, inputOps := lps.instrs[sI.instr.pc].regs()
 				stage := lps.loopStage(bundles, sI.instr.pc, II)
 
 				for r, depPc := range dep.loopInvariantDeps {
 					for i, op := range ops {
-						if *op == r {
+						if inputOps[i] == r {
 							dst, _ := instrs[depPc].regs()
 							*op = *dst
 
@@ -271,10 +453,10 @@ func (lps *loopPipScheduler) allocateRegisterPhase3(bundles *blockBundles, instr
 
 				for r, depPc := range dep.localDeps {
 					for i, op := range ops {
-						if *op == r {
+						if inputOps[i] == r {
 							dst, _ := instrs[depPc].regs()
 							stageDep := lps.loopStage(bundles, depPc, II)
-							op.num = dst.num + uint8(stage-stageDep)
+							op.num = dst.num + stage - stageDep
 
 							lps.opAllocated[sI.instr.pc][i] = true
 						}
@@ -283,11 +465,11 @@ func (lps *loopPipScheduler) allocateRegisterPhase3(bundles *blockBundles, instr
 
 				for r, iDep := range dep.interloopDeps {
 					for i, op := range ops {
-						if *op == r {
+						if inputOps[i] == r {
 							depPc := iDep.body
 							dst, _ := instrs[depPc].regs()
 							stageDep := lps.loopStage(bundles, depPc, II)
-							op.num = dst.num + uint8(stage-stageDep) + 1
+							op.num = dst.num + stage - stageDep + 1
 
 							lps.opAllocated[sI.instr.pc][i] = true
 						}
@@ -304,7 +486,7 @@ func (lps *loopPipScheduler) loopStage(bundles *blockBundles, pc int, II int) in
 	return inLoopIdx / II
 }
 
-func (lps *loopPipScheduler) allocateRegisterPhase4(bundles *blockBundles, instrs []*instruction, currStaticRegNum uint8, II int) uint8 {
+func (lps *loopPipScheduler) allocateRegisterPhase4(bundles *blockBundles, instrs []*instruction, currStaticRegNum int, II int) int {
 	lps.allocateRegisterPhase4InterLoop(bundles, instrs, II)
 	currStaticRegNum = lps.allocateRegisterPhase4LocalDeps(bundles, instrs, currStaticRegNum)
 	lps.allocateRegisterPhase4PostDeps(bundles, instrs, II)
@@ -327,7 +509,7 @@ func (lps *loopPipScheduler) allocateRegisterPhase4InterLoop(bundles *blockBundl
 						bodyInstr := instrs[dep.body]
 						bodyDst, _ := bodyInstr.regs()
 
-						dst.num = bodyDst.num - uint8(bodyStage) + 1
+						dst.num = bodyDst.num - bodyStage + 1
 
 						lps.dstAllocated[sI.instr.pc] = true
 					}
@@ -337,11 +519,12 @@ func (lps *loopPipScheduler) allocateRegisterPhase4InterLoop(bundles *blockBundl
 	}
 }
 
-func (lps *loopPipScheduler) allocateRegisterPhase4LocalDeps(bundles *blockBundles, instrs []*instruction, currStaticRegNum uint8) uint8 {
+func (lps *loopPipScheduler) allocateRegisterPhase4LocalDeps(bundles *blockBundles, instrs []*instruction, currStaticRegNum int) int {
 	for _, b := range bundles.bb0AndBB2() {
 		for _, sI := range b {
 			if sI != nil && sI.instr.pc != -1 {
 				dst, ops := sI.instr.mutRegs()
+				_, inputOps := lps.instrs[sI.instr.pc].regs()
 				dep := lps.deps.deps[sI.instr.pc]
 
 				// Update ops
@@ -349,7 +532,7 @@ func (lps *loopPipScheduler) allocateRegisterPhase4LocalDeps(bundles *blockBundl
 					depInstr := instrs[depPc]
 					depDst, _ := depInstr.regs()
 					for i, op := range ops {
-						if *op == depReg {
+						if inputOps[i] == depReg {
 							*op = *depDst
 
 							lps.opAllocated[sI.instr.pc][i] = true
@@ -375,6 +558,7 @@ func (lps *loopPipScheduler) allocateRegisterPhase4PostDeps(bundles *blockBundle
 		for _, sI := range b {
 			if sI != nil && sI.instr.pc != -1 {
 				_, ops := sI.instr.mutRegs()
+				_, inputOps := lps.instrs[sI.instr.pc].regs()
 				dep := lps.deps.deps[sI.instr.pc]
 				stage := loopStages(bundles, II) - 1
 
@@ -384,8 +568,8 @@ func (lps *loopPipScheduler) allocateRegisterPhase4PostDeps(bundles *blockBundle
 					depStage := lps.loopStage(bundles, depPc, II)
 
 					for i, op := range ops {
-						if *op == depReg {
-							op.num = depDst.num + uint8(stage-depStage)
+						if inputOps[i] == depReg {
+							op.num = depDst.num + stage - depStage
 
 							lps.opAllocated[sI.instr.pc][i] = true
 						}
@@ -401,6 +585,7 @@ func (lps *loopPipScheduler) allocateRegisterPhase4LoopInvariants(bundles *block
 		for _, sI := range b {
 			if sI != nil && sI.instr.pc != -1 {
 				_, ops := sI.instr.mutRegs()
+				_, inputOps := lps.instrs[sI.instr.pc].regs()
 				dep := lps.deps.deps[sI.instr.pc]
 
 				for depReg, depPc := range dep.loopInvariantDeps {
@@ -408,7 +593,7 @@ func (lps *loopPipScheduler) allocateRegisterPhase4LoopInvariants(bundles *block
 					depDst, _ := depInstr.regs()
 
 					for i, op := range ops {
-						if *op == depReg {
+						if inputOps[i] == depReg {
 							*op = *depDst
 
 							lps.opAllocated[sI.instr.pc][i] = true
@@ -420,7 +605,7 @@ func (lps *loopPipScheduler) allocateRegisterPhase4LoopInvariants(bundles *block
 	}
 }
 
-func (lps *loopPipScheduler) allocateRegisterUnassignedRead(bundles *blockBundles, currStaticRegNum uint8) uint8 {
+func (lps *loopPipScheduler) allocateRegisterUnassignedRead(bundles *blockBundles, currStaticRegNum int) int {
 	for i := 0; i < bundles.len(); i++ {
 		b := bundles.get(i)
 		for _, sI := range b {
@@ -464,7 +649,7 @@ func (lps *loopPipScheduler) prepLoopInit(bundles *blockBundles, II int) *blockB
 	}
 
 	if len(bundles.bb0) == 0 {
-		bundles.extendBlockBy(bundles.bb0Start(), 1)
+		bundles.extendBlockBy(&bundles.bb0, 1)
 	}
 	lastBB0Bundle := bundles.get(bundles.bb1Start() - 1)
 
@@ -475,7 +660,7 @@ func (lps *loopPipScheduler) prepLoopInit(bundles *blockBundles, II int) *blockB
 			type_: mov,
 			regA: reg{
 				type_: predReg,
-				num:   32,
+				num:   lps.md.firstRotatingPred(),
 			},
 			pred:    true,
 			usesReg: false,
@@ -497,20 +682,32 @@ func (lps *loopPipScheduler) prepLoopInit(bundles *blockBundles, II int) *blockB
 		},
 	}
 
-	for _, sI := range []*specIns{movEC, movP32True} {
-		for lastBB0Bundle.addInst(sI) == noSlot {
-			bundles.extendBlockBy(bundles.bb0Start(), 1)
+	prep := []*specIns{movEC, movP32True}
+	for stage := 1; lps.clearPredicates && stage < numStages; stage++ {
+		prep = append(prep, &specIns{
+			pred: nil,
+			instr: instruction{
+				pc:    -1,
+				type_: mov,
+				regA: reg{
+					type_: predReg,
+					num:   lps.md.firstRotatingPred() + stage,
+				},
+				pred:    false,
+				usesReg: false,
+			},
+		})
+	}
+
+	for _, sI := range prep {
+		for lastBB0Bundle.addInst(lps.md, sI) == noSlot {
+			bundles.extendBlockBy(&bundles.bb0, 1)
 			lastBB0Bundle = bundles.get(bundles.bb1Start() - 1)
 		}
 	}
 
 	// Adjust branch address.
-	for i := 0; i < bundles.len(); i++ {
-		b := bundles.get(i)
-		if b[branch] != nil {
-			b[branch].instr.imm = int64(bundles.bb1Start())
-		}
-	}
+	bundles.retargetBranches()
 
 	return bundles
 }
@@ -526,10 +723,10 @@ func (lps *loopPipScheduler) prepLoopBody(bundles *blockBundles, II int) *blockB
 		for slot, sI := range b {
 			if sI != nil && sI.instr.type_ != nop {
 				if !sI.instr.type_.isBranch() {
-					stage := uint8(i / II)
+					stage := i / II
 					sI.pred = &reg{
 						type_: predReg,
-						num:   32 + stage,
+						num:   lps.md.firstRotatingPred() + stage,
 					}
 				}
 				newBB1[i%II][slot] = sI
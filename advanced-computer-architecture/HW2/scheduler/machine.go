@@ -0,0 +1,351 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const defaultMaxCycles = 1 << 20
+
+// MachineState is the architectural state of the VLIW470 processor.
+// Registers and Predicates are indexed by physical register, the rotating names map to them through RRB.
+type MachineState struct {
+	Cycles     int               `json:"cycles"`
+	Registers  []uint64          `json:"registers"`
+	Predicates []bool            `json:"predicates"`
+	LC         uint64            `json:"LC"`
+	EC         uint64            `json:"EC"`
+	RRB        int               `json:"RRB"`
+	Memory     map[uint64]uint64 `json:"memory"`
+}
+
+// copy returns a deep copy of the state with register files of the machine sizes.
+func (s *MachineState) copy(md *MachineDescription) MachineState {
+	copied := *s
+	copied.Registers = make([]uint64, md.Registers.size())
+	copy(copied.Registers, s.Registers)
+	copied.Predicates = make([]bool, md.Predicates.size())
+	copy(copied.Predicates, s.Predicates)
+	copied.Memory = make(map[uint64]uint64, len(s.Memory))
+	for addr, v := range s.Memory {
+		copied.Memory[addr] = v
+	}
+	return copied
+}
+
+type pendingWrite struct {
+	due int
+	reg reg
+	// store writes the value to the memory at addr instead of to the register.
+	store bool
+	addr  uint64
+	value uint64
+}
+
+// machine executes bundles cycle by cycle, the result of an instruction is visible its latency in bundles after
+// it was issued and every instruction of a bundle reads the values from before the bundle. The stores write the
+// memory with their latency too.
+type machine struct {
+	md        *MachineDescription
+	state     MachineState
+	pending   []pendingWrite
+	maxCycles int
+	// sequential makes every result visible to the next instruction, to run the input program.
+	sequential bool
+	// writes records the values written by every instruction of the input program, by pc.
+	writes map[int][]uint64
+	// fill gives the value of the memory words never stored to, they read as zero when nil.
+	fill func(addr uint64) uint64
+	// loopCount replaces the immediate of the mov instructions to LC when not nil.
+	loopCount *uint64
+}
+
+func newMachine(md *MachineDescription, initial MachineState) *machine {
+	m := &machine{
+		md:        md,
+		state:     initial.copy(md),
+		maxCycles: defaultMaxCycles,
+		writes:    make(map[int][]uint64),
+	}
+	m.state.Cycles = 0
+	return m
+}
+
+// physical returns the register named num under the current RRB.
+func (m *machine) physical(r reg) int {
+	rf := m.md.Registers
+	if r.type_ == predReg {
+		rf = m.md.Predicates
+	}
+	if int(r.num) < rf.Static {
+		return int(r.num)
+	}
+	rotated := (int(r.num) - rf.Static + m.state.RRB) % rf.Rotating
+	if rotated < 0 {
+		rotated += rf.Rotating
+	}
+	return rf.Static + rotated
+}
+
+func (m *machine) load(addr uint64) uint64 {
+	if v, ok := m.state.Memory[addr]; ok || m.fill == nil {
+		return v
+	}
+	return m.fill(addr)
+}
+
+func (m *machine) read(r reg) uint64 {
+	switch r.type_ {
+	case xReg:
+		return m.state.Registers[m.physical(r)]
+	case predReg:
+		if m.state.Predicates[m.physical(r)] {
+			return 1
+		}
+		return 0
+	case specialReg:
+		if r.num == lcReg {
+			return m.state.LC
+		}
+		return m.state.EC
+	default:
+		panic("impossible!")
+	}
+}
+
+// write schedules the write of the register, its rotating name is resolved now.
+func (m *machine) write(r reg, value uint64, latency int, pc int) {
+	if r.type_ != specialReg {
+		r.num = m.physical(r)
+	}
+	if pc >= 0 {
+		m.writes[pc] = append(m.writes[pc], value)
+	}
+	if m.sequential {
+		latency = 0
+	}
+	m.pending = append(m.pending, pendingWrite{due: m.state.Cycles + latency, reg: r, value: value})
+}
+
+// store schedules the write of the memory word.
+func (m *machine) store(addr uint64, value uint64, latency int, pc int) {
+	if pc >= 0 {
+		m.writes[pc] = append(m.writes[pc], value)
+	}
+	if m.sequential {
+		latency = 0
+	}
+	m.pending = append(m.pending, pendingWrite{due: m.state.Cycles + latency, store: true, addr: addr, value: value})
+}
+
+// retire applies the writes due by the current cycle, in issue order.
+func (m *machine) retire(all bool) {
+	remaining := m.pending[:0]
+	for _, w := range m.pending {
+		if !all && w.due > m.state.Cycles {
+			remaining = append(remaining, w)
+			continue
+		}
+		if w.store {
+			m.state.Memory[w.addr] = w.value
+			continue
+		}
+		switch w.reg.type_ {
+		case xReg:
+			m.state.Registers[w.reg.num] = w.value
+		case predReg:
+			m.state.Predicates[w.reg.num] = w.value != 0
+		case specialReg:
+			if w.reg.num == lcReg {
+				m.state.LC = w.value
+			} else {
+				m.state.EC = w.value
+			}
+		}
+	}
+	m.pending = remaining
+}
+
+// issue executes the instruction, it returns the index of the next bundle if it is a taken branch.
+func (m *machine) issue(sI *specIns) (target int, taken bool) {
+	if sI.pred != nil && m.read(*sI.pred) == 0 {
+		return 0, false
+	}
+
+	i := sI.instr
+	switch i.type_ {
+	case add:
+		m.write(i.regA, m.read(i.regB)+m.read(i.regC), m.md.latency(i), i.pc)
+	case addi:
+		m.write(i.regA, m.read(i.regB)+uint64(i.imm), m.md.latency(i), i.pc)
+	case sub:
+		m.write(i.regA, m.read(i.regB)-m.read(i.regC), m.md.latency(i), i.pc)
+	case mulu:
+		m.write(i.regA, m.read(i.regB)*m.read(i.regC), m.md.latency(i), i.pc)
+	case ld:
+		m.write(i.regA, m.load(m.read(i.regB)+uint64(i.imm)), m.md.latency(i), i.pc)
+	case st:
+		m.store(m.read(i.regB)+uint64(i.imm), m.read(i.regA), m.md.latency(i), i.pc)
+	case mov:
+		switch {
+		case i.regA.type_ == predReg && i.pred:
+			m.write(i.regA, 1, m.md.latency(i), i.pc)
+		case i.regA.type_ == predReg:
+			m.write(i.regA, 0, m.md.latency(i), i.pc)
+		case i.usesReg:
+			m.write(i.regA, m.read(i.regB), m.md.latency(i), i.pc)
+		case i.regA == reg{type_: specialReg, num: lcReg} && m.loopCount != nil:
+			m.write(i.regA, *m.loopCount, m.md.latency(i), i.pc)
+		default:
+			m.write(i.regA, uint64(i.imm), m.md.latency(i), i.pc)
+		}
+	case loop:
+		if m.state.LC > 0 {
+			m.state.LC--
+			return int(i.imm), true
+		}
+	case loopPip:
+		switch {
+		case m.state.LC > 0:
+			m.state.LC--
+			m.state.RRB--
+			m.state.Predicates[m.physical(reg{type_: predReg, num: m.md.firstRotatingPred()})] = true
+			return int(i.imm), true
+		case m.state.EC > 0:
+			m.state.EC--
+			m.state.RRB--
+			m.state.Predicates[m.physical(reg{type_: predReg, num: m.md.firstRotatingPred()})] = false
+			return int(i.imm), true
+		}
+	case nop:
+	default:
+		panic("impossible!")
+	}
+	return 0, false
+}
+
+// run executes the bundles from the first one until the program counter leaves them.
+func (m *machine) run(bundles []bundle) error {
+	pc := 0
+	for pc < len(bundles) {
+		if m.state.Cycles >= m.maxCycles {
+			return fmt.Errorf("program did not finish in %d cycles", m.maxCycles)
+		}
+		m.retire(false)
+
+		next := pc + 1
+		for _, sI := range bundles[pc] {
+			if sI == nil {
+				continue
+			}
+			if target, taken := m.issue(sI); taken {
+				next = target
+			}
+		}
+		if m.sequential {
+			m.retire(true)
+		}
+
+		m.state.Cycles++
+		pc = next
+	}
+	m.retire(true)
+	return nil
+}
+
+// sequentialBundles lays the input program out one instruction per bundle, the loop targets stay valid.
+func sequentialBundles(md *MachineDescription, instrs []instruction) []bundle {
+	bundles := make([]bundle, len(instrs))
+	for i := range instrs {
+		if instrs[i].type_ != nop {
+			bundles[i].addInst(md, &specIns{instr: instrs[i]})
+		}
+	}
+	return bundles
+}
+
+func (bb *blockBundles) all() []bundle {
+	bundles := make([]bundle, 0, bb.len())
+	bundles = append(bundles, bb.bb0...)
+	bundles = append(bundles, bb.bb1...)
+	return append(bundles, bb.bb2...)
+}
+
+func parseSpecIns(asm string) (*specIns, error) {
+	sI := &specIns{}
+	asm = strings.TrimSpace(asm)
+	if strings.HasPrefix(asm, "(") {
+		end := strings.Index(asm, ")")
+		if end < 0 {
+			return nil, fmt.Errorf("malformed predicate: %s", asm)
+		}
+		pred, err := parseReg(strings.TrimSpace(asm[1:end]))
+		if err != nil || pred.type_ != predReg {
+			return nil, fmt.Errorf("malformed predicate: %s", asm)
+		}
+		sI.pred = &pred
+		asm = asm[end+1:]
+	}
+
+	var err error
+	sI.instr, err = parseInstruction(asm)
+	if err != nil {
+		return nil, err
+	}
+	sI.instr.pc = -1
+	return sI, nil
+}
+
+// parseBundles decodes a schedule in the JSON output format.
+func parseBundles(md *MachineDescription, data []byte) ([]bundle, error) {
+	var encoded [][]string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+
+	bundles := make([]bundle, len(encoded))
+	for i, slots := range encoded {
+		if len(slots) != md.numSlots {
+			return nil, fmt.Errorf("bundle %d has %d slots", i, len(slots))
+		}
+		for slot, asm := range slots {
+			sI, err := parseSpecIns(asm)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing bundle %d, %w", i, err)
+			}
+			if sI.instr.type_ == nop {
+				continue
+			}
+			if err = md.checkRegs(sI.instr); err != nil {
+				return nil, fmt.Errorf("error parsing bundle %d, %w", i, err)
+			}
+			if sI.pred != nil && int(sI.pred.num) >= md.Predicates.size() {
+				return nil, fmt.Errorf("error parsing bundle %d, register %s does not exist on the machine", i, *sI.pred)
+			}
+			if !md.canExecute(bundleSlot(slot), sI.instr.type_) {
+				return nil, fmt.Errorf("error parsing bundle %d, slot %d cannot execute %s", i, slot, sI.instr.type_)
+			}
+			bundles[i][slot] = sI
+		}
+	}
+	return bundles, nil
+}
+
+// Simulate runs a schedule in the JSON output format on the machine from the initial state and returns the
+// final state. maxCycles bounds the simulation of schedules that do not terminate, 0 selects a default bound.
+func Simulate(md *MachineDescription, schedule []byte, initial MachineState, maxCycles int) (MachineState, error) {
+	bundles, err := parseBundles(md, schedule)
+	if err != nil {
+		return MachineState{}, fmt.Errorf("error simulating, %w", err)
+	}
+
+	m := newMachine(md, initial)
+	if maxCycles > 0 {
+		m.maxCycles = maxCycles
+	}
+	if err = m.run(bundles); err != nil {
+		return m.state, fmt.Errorf("error simulating, %w", err)
+	}
+	return m.state, nil
+}
@@ -0,0 +1,188 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// maxSlots bounds the number of slots of the bundles of every machine.
+const maxSlots = 16
+
+// Unit is a class of functional units, bundles have one slot per unit of the class.
+type Unit struct {
+	Name    string   `json:"name"`
+	Count   int      `json:"count"`
+	Opcodes []string `json:"opcodes"`
+}
+
+// RegisterFile gives the number of static registers, the rotating ones are numbered after them.
+type RegisterFile struct {
+	Static   int `json:"static"`
+	Rotating int `json:"rotating"`
+}
+
+func (rf RegisterFile) size() int {
+	return rf.Static + rf.Rotating
+}
+
+// MachineDescription describes a variant of the VLIW470. The slots of the bundles follow the order of the
+// units, the opcodes missing from Latencies take one cycle.
+type MachineDescription struct {
+	Units      []Unit         `json:"units"`
+	Latencies  map[string]int `json:"latencies"`
+	Registers  RegisterFile   `json:"registers"`
+	Predicates RegisterFile   `json:"predicates"`
+
+	numSlots int
+	slots    map[instructionType][]bundleSlot
+	branch   bundleSlot
+}
+
+// VLIW470 returns the description of the machine of the assignment.
+func VLIW470() *MachineDescription {
+	md := &MachineDescription{
+		Units: []Unit{
+			{Name: "alu", Count: 2, Opcodes: []string{"add", "addi", "sub", "mov"}},
+			{Name: "mult", Count: 1, Opcodes: []string{"mulu"}},
+			{Name: "mem", Count: 1, Opcodes: []string{"ld", "st"}},
+			{Name: "branch", Count: 1, Opcodes: []string{"loop", "loop.pip"}},
+		},
+		Latencies:  map[string]int{"mulu": 3},
+		Registers:  RegisterFile{Static: 32, Rotating: 64},
+		Predicates: RegisterFile{Static: 32, Rotating: 64},
+	}
+	if err := md.init(); err != nil {
+		panic("impossible!")
+	}
+	return md
+}
+
+// ParseMachineDescription decodes and validates a machine description in JSON.
+func ParseMachineDescription(data []byte) (*MachineDescription, error) {
+	md := &MachineDescription{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, fmt.Errorf("error parsing machine description, %w", err)
+	}
+	if err := md.init(); err != nil {
+		return nil, fmt.Errorf("error parsing machine description, %w", err)
+	}
+	return md, nil
+}
+
+func (md *MachineDescription) init() error {
+	md.numSlots = 0
+	md.slots = make(map[instructionType][]bundleSlot)
+	for _, unit := range md.Units {
+		if unit.Count <= 0 {
+			return fmt.Errorf("unit %s has no slot", unit.Name)
+		}
+		if md.numSlots+unit.Count > maxSlots {
+			return fmt.Errorf("bundles have more than %d slots", maxSlots)
+		}
+		for _, opcode := range unit.Opcodes {
+			it, err := parseMnemonic(opcode)
+			if err != nil {
+				return err
+			}
+			if it == nop || md.slots[it] != nil {
+				return fmt.Errorf("unit %s cannot execute %s", unit.Name, opcode)
+			}
+			for slot := 0; slot < unit.Count; slot++ {
+				md.slots[it] = append(md.slots[it], bundleSlot(md.numSlots+slot))
+			}
+		}
+		md.numSlots += unit.Count
+	}
+
+	for _, it := range allInstructions {
+		if it != nop && md.slots[it] == nil {
+			return fmt.Errorf("no unit executes %s", it)
+		}
+	}
+	if len(md.slots[loop]) != 1 || md.slots[loopPip][0] != md.slots[loop][0] {
+		return fmt.Errorf("loop and loop.pip need the same single slot")
+	}
+	md.branch = md.slots[loop][0]
+	for _, it := range allInstructions {
+		if it != nop && it.isBranch() != (md.slots[it][0] == md.branch) {
+			return fmt.Errorf("%s shares the branch slot", it)
+		}
+	}
+
+	for opcode, latency := range md.Latencies {
+		if _, err := parseMnemonic(opcode); err != nil {
+			return err
+		}
+		if latency < 1 {
+			return fmt.Errorf("latency of %s must be positive", opcode)
+		}
+	}
+
+	for _, rf := range []RegisterFile{md.Registers, md.Predicates} {
+		// The loops need the static registers and the rotating predicate of the first stage.
+		if rf.Static < 2 || rf.Rotating < 1 || rf.size() > 256 {
+			return fmt.Errorf("register files need 2 to 256 registers with at least one rotating")
+		}
+	}
+	return nil
+}
+
+func (md *MachineDescription) latency(i instruction) int {
+	if latency, ok := md.Latencies[string(i.type_)]; ok {
+		return latency
+	}
+	return 1
+}
+
+// memoryLatency returns the bundles from a load or store to a later access of the same address, one of them a
+// store, for the later one to see the memory after the earlier one. Loads read the memory when issued and stores
+// write it when they land, the writes due by a bundle land before it issues and in the order they were issued.
+func (md *MachineDescription) memoryLatency(from, to instruction) int {
+	switch {
+	case to.type_ == ld:
+		return md.latency(from)
+	case from.type_ == ld:
+		return 1 - md.latency(to)
+	default:
+		return maxInt(1, md.latency(from)-md.latency(to))
+	}
+}
+
+// slotsOf returns the slots of a bundle that can execute the instruction.
+func (md *MachineDescription) slotsOf(it instructionType) []bundleSlot {
+	if it == nop {
+		panic(fmt.Sprint("Unexpected instruction type to add:", it))
+	}
+	return md.slots[it]
+}
+
+func (md *MachineDescription) canExecute(slot bundleSlot, it instructionType) bool {
+	for _, s := range md.slots[it] {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+func (md *MachineDescription) firstRotatingReg() int {
+	return md.Registers.Static
+}
+
+func (md *MachineDescription) firstRotatingPred() int {
+	return md.Predicates.Static
+}
+
+// checkRegs reports the registers of the instruction missing from the register files.
+func (md *MachineDescription) checkRegs(i instruction) error {
+	dst, ops := i.regs()
+	if dst != nil {
+		ops = append(ops, *dst)
+	}
+	for _, r := range ops {
+		if (r.type_ == xReg && int(r.num) >= md.Registers.size()) || (r.type_ == predReg && int(r.num) >= md.Predicates.size()) {
+			return fmt.Errorf("register %s does not exist on the machine", r)
+		}
+	}
+	return nil
+}
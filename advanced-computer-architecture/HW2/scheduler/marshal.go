@@ -66,9 +66,10 @@ func (s specIns) MarshalText() ([]byte, error) {
 	return []byte(res + s.instr.String()), nil
 }
 
-func (b *bundle) MarshalJSON() ([]byte, error) {
-	var derefed [5]specIns
-	for slot, instr := range b {
+// slots returns the instructions of the slots of the machine, the empty ones hold a nop.
+func (b *bundle) slots(md *MachineDescription) []specIns {
+	derefed := make([]specIns, md.numSlots)
+	for slot, instr := range b[:md.numSlots] {
 		if instr == nil {
 			derefed[slot] = specIns{
 				pred:  nil,
@@ -78,14 +79,14 @@ func (b *bundle) MarshalJSON() ([]byte, error) {
 			derefed[slot] = *instr
 		}
 	}
-	return json.Marshal(derefed)
+	return derefed
 }
 
 func (bb *blockBundles) MarshalJSON() ([]byte, error) {
-	bundles := make([]bundle, 0, bb.len())
-	bundles = append(bundles, bb.bb0...)
-	bundles = append(bundles, bb.bb1...)
-	bundles = append(bundles, bb.bb2...)
-
-	return json.Marshal(bundles)
+	bundles := bb.all()
+	slots := make([][]specIns, len(bundles))
+	for i := range bundles {
+		slots[i] = bundles[i].slots(bb.md)
+	}
+	return json.Marshal(slots)
 }
@@ -0,0 +1,193 @@
+package scheduler
+
+// memoryDep is a load or store of the loop body that may access the address of a later one, distance iterations
+// before it.
+type memoryDep struct {
+	pc       int
+	distance int
+}
+
+// valueRoot is a value the addresses are relative to: the value written by an instruction, the one of a register
+// before the program, or zero for the constant addresses.
+type valueRoot struct {
+	pc    int // The instruction writing the value, -1 for the other roots.
+	input reg
+	zero  bool
+}
+
+// address is the symbolic address of a load or store, the root plus the offset, plus the stride times the
+// iteration of the loop ending at loopEnd. An address not known may be any.
+type address struct {
+	known   bool
+	root    valueRoot
+	offset  int64
+	stride  int64
+	loopEnd int
+}
+
+// memoryAnalysis follows the base registers of the loads and stores through the addi and mov instructions, back to
+// the values they are relative to, and orders the accesses that may touch the same address.
+type memoryAnalysis struct {
+	instrs []instruction
+	deps   []dependency
+	// The basic block of every instruction and the loops around it, innermost first.
+	blocks []int
+	loops  [][]region
+}
+
+// addMemoryDeps fills the memory dependencies of the loads and stores.
+func (ma *memoryAnalysis) addMemoryDeps() {
+	var accesses []int
+	addrs := make(map[int]address)
+	for pc, instr := range ma.instrs {
+		if instr.type_ == ld || instr.type_ == st {
+			accesses = append(accesses, pc)
+			addrs[pc] = ma.address(pc)
+		}
+	}
+
+	for i, pc := range accesses {
+		dep := &ma.deps[pc]
+		for _, earlier := range accesses[:i] {
+			if ma.instrs[earlier].type_ == st || ma.instrs[pc].type_ == st {
+				if ma.mayAlias(earlier, pc, addrs) {
+					dep.memoryDeps = append(dep.memoryDeps, earlier)
+				}
+			}
+		}
+
+		if len(ma.loops[pc]) == 0 {
+			continue
+		}
+		l := ma.loops[pc][0]
+		for _, other := range accesses {
+			if ma.instrs[other].type_ != st && ma.instrs[pc].type_ != st {
+				continue
+			}
+			if len(ma.loops[other]) == 0 || ma.loops[other][0].end != l.end {
+				continue
+			}
+			if distance := carriedDistance(ma.within(addrs[other], &l), ma.within(addrs[pc], &l)); distance != 0 {
+				dep.interloopMemoryDeps = append(dep.interloopMemoryDeps, memoryDep{pc: other, distance: distance})
+			}
+		}
+	}
+}
+
+// mayAlias reports whether the accesses may touch the same address. In a basic block their values are the ones of
+// the same iteration, elsewhere only the values written once by the program are.
+func (ma *memoryAnalysis) mayAlias(a, b int, addrs map[int]address) bool {
+	if ma.blocks[a] == ma.blocks[b] {
+		return sameAddress(addrs[a], addrs[b])
+	}
+	return sameAddress(ma.within(addrs[a], nil), ma.within(addrs[b], nil))
+}
+
+// within returns the address if its root does not change while the loop runs, or during the whole program for a
+// nil loop.
+func (ma *memoryAnalysis) within(a address, l *region) address {
+	switch {
+	case !a.known:
+		return a
+	case l == nil && (a.stride != 0 || (a.root.pc != -1 && len(ma.loops[a.root.pc]) != 0)):
+		return address{}
+	case l != nil && a.root.pc >= l.start && a.root.pc < l.end:
+		return address{}
+	default:
+		return a
+	}
+}
+
+// sameAddress reports whether the accesses may touch the same address in the same iteration.
+func sameAddress(a, b address) bool {
+	return !a.known || !b.known || a.root != b.root || a.stride != b.stride || a.offset == b.offset
+}
+
+// carriedDistance returns the fewest iterations after which the second access may touch the address the first
+// one did, 0 if it never does.
+func carriedDistance(a, b address) int {
+	if !a.known || !b.known || a.root != b.root || a.stride != b.stride {
+		return 1
+	}
+	diff := a.offset - b.offset
+	switch {
+	case a.stride == 0 && diff == 0:
+		return 1
+	case a.stride == 0 || diff%a.stride != 0 || diff/a.stride < 1:
+		return 0
+	default:
+		return int(diff / a.stride)
+	}
+}
+
+// address returns the address of the load or store, its stride counts the iterations of the innermost loop
+// around it.
+func (ma *memoryAnalysis) address(pc int) address {
+	instr := ma.instrs[pc]
+	a := ma.value(instr.regB, pc)
+	a.offset += instr.imm
+	if a.stride != 0 && (len(ma.loops[pc]) == 0 || ma.loops[pc][0].end != a.loopEnd) {
+		return address{}
+	}
+	return a
+}
+
+// value returns the value of the register the instruction reads.
+func (ma *memoryAnalysis) value(r reg, pc int) address {
+	dep := ma.deps[pc]
+	if iDep, ok := dep.interloopDeps[r]; ok {
+		return ma.induction(r, pc, iDep.init, iDep.body)
+	}
+	for _, deps := range []map[reg]int{dep.localDeps, dep.loopInvariantDeps, dep.postLoopDeps} {
+		if depPc, ok := deps[r]; ok {
+			return ma.written(depPc)
+		}
+	}
+
+	// Read before being written in a loop, the value of the previous iteration after the first one.
+	for _, l := range ma.loops[pc] {
+		for w := l.start; w < l.end; w++ {
+			if dst, _ := ma.instrs[w].regs(); dst != nil && *dst == r {
+				return address{}
+			}
+		}
+	}
+	return address{known: true, root: valueRoot{pc: -1, input: r}}
+}
+
+// induction returns the value of an interloop dependency if it is an induction variable of the innermost loop
+// around the instruction, the loop only adds a constant to the register with an addi.
+func (ma *memoryAnalysis) induction(r reg, pc, init, body int) address {
+	l := ma.loops[pc][0]
+	step := ma.instrs[body]
+	if body < l.start || body >= l.end || step.type_ != addi || step.regB != r {
+		return address{}
+	}
+	if iDep, ok := ma.deps[body].interloopDeps[r]; !ok || iDep.body != body {
+		return address{}
+	}
+
+	a := ma.written(init)
+	if !a.known || a.stride != 0 {
+		return address{}
+	}
+	a.stride, a.loopEnd = step.imm, l.end
+	return a
+}
+
+// written returns the value the instruction writes.
+func (ma *memoryAnalysis) written(pc int) address {
+	instr := ma.instrs[pc]
+	switch {
+	case instr.type_ == addi:
+		a := ma.value(instr.regB, pc)
+		a.offset += instr.imm
+		return a
+	case instr.type_ == mov && instr.usesReg:
+		return ma.value(instr.regB, pc)
+	case instr.type_ == mov:
+		return address{known: true, root: valueRoot{pc: -1, zero: true}, offset: instr.imm}
+	default:
+		return address{known: true, root: valueRoot{pc: pc}}
+	}
+}
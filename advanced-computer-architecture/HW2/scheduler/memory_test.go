@@ -0,0 +1,151 @@
+package scheduler
+
+import "testing"
+
+func TestCarriedDistance(t *testing.T) {
+	root := valueRoot{pc: 1}
+	strided := func(offset, stride int64) address {
+		return address{known: true, root: root, offset: offset, stride: stride, loopEnd: 5}
+	}
+
+	tests := []struct {
+		name     string
+		a, b     address
+		distance int
+	}{
+		{"next iteration", strided(8, 8), strided(0, 8), 1},
+		{"two iterations", strided(16, 8), strided(0, 8), 2},
+		{"negative stride", strided(0, -8), strided(16, -8), 2},
+		{"earlier iteration", strided(0, 8), strided(16, 8), 0},
+		{"earlier iteration, negative stride", strided(16, -8), strided(0, -8), 0},
+		{"same iteration", strided(8, 8), strided(8, 8), 0},
+		{"offset not a multiple of the stride", strided(12, 8), strided(0, 8), 0},
+		{"same invariant address", strided(8, 0), strided(8, 0), 1},
+		{"other invariant address", strided(8, 0), strided(0, 0), 0},
+		{"unknown address", address{}, strided(0, 8), 1},
+		{"other root", strided(8, 8), address{known: true, root: valueRoot{pc: 2}, stride: 8, loopEnd: 5}, 1},
+		{"other stride", strided(16, 8), strided(0, 4), 1},
+	}
+	for _, tt := range tests {
+		if got := carriedDistance(tt.a, tt.b); got != tt.distance {
+			t.Errorf("%s: carriedDistance(%+v, %+v) = %d, want %d", tt.name, tt.a, tt.b, got, tt.distance)
+		}
+	}
+}
+
+func TestMemoryDeps(t *testing.T) {
+	tests := []struct {
+		name      string
+		program   []string
+		pc        int
+		deps      []int
+		interloop []memoryDep
+	}{
+		{
+			name:    "same address",
+			program: []string{"mov x2, 4096", "st x3, 0(x2)", "ld x4, 0(x2)"},
+			pc:      2,
+			deps:    []int{1},
+		},
+		{
+			name:    "other offset",
+			program: []string{"mov x2, 4096", "st x3, 0(x2)", "ld x4, 8(x2)"},
+			pc:      2,
+		},
+		{
+			name:    "unknown base",
+			program: []string{"ld x2, 0(x5)", "st x3, 0(x6)", "ld x4, 8(x2)"},
+			pc:      2,
+			deps:    []int{1},
+		},
+		{
+			name:      "store to the next element",
+			program:   []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "st x3, 8(x2)", "addi x2, x2, 8", "loop 2"},
+			pc:        2,
+			interloop: []memoryDep{{pc: 3, distance: 1}},
+		},
+		{
+			name:    "store to the same element",
+			program: []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "st x3, 0(x2)", "addi x2, x2, 8", "loop 2"},
+			pc:      3,
+			deps:    []int{2},
+		},
+		{
+			name:      "store to the previous element",
+			program:   []string{"mov LC, 9", "mov x2, 4096", "ld x3, 8(x2)", "st x3, 0(x2)", "addi x2, x2, -8", "loop 2"},
+			pc:        2,
+			interloop: []memoryDep{{pc: 3, distance: 1}},
+		},
+		{
+			name:      "invariant address",
+			program:   []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "addi x3, x3, 1", "st x3, 0(x2)", "loop 2"},
+			pc:        2,
+			interloop: []memoryDep{{pc: 4, distance: 1}},
+		},
+		{
+			name:      "unknown root in the loop",
+			program:   []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x4)", "st x3, 0(x2)", "addi x2, x2, 8", "loop 2"},
+			pc:        2,
+			interloop: []memoryDep{{pc: 3, distance: 1}},
+		},
+	}
+	for _, tt := range tests {
+		deps := programDeps(t, tt.program)
+		dep := deps.deps[tt.pc]
+		if !equalInts(dep.memoryDeps, tt.deps) {
+			t.Errorf("%s: memory dependencies of %d are %v, want %v", tt.name, tt.pc, dep.memoryDeps, tt.deps)
+		}
+		if len(dep.interloopMemoryDeps) != len(tt.interloop) {
+			t.Errorf("%s: interloop memory dependencies of %d are %v, want %v", tt.name, tt.pc, dep.interloopMemoryDeps, tt.interloop)
+			continue
+		}
+		for i, mDep := range dep.interloopMemoryDeps {
+			if mDep != tt.interloop[i] {
+				t.Errorf("%s: interloop memory dependencies of %d are %v, want %v", tt.name, tt.pc, dep.interloopMemoryDeps, tt.interloop)
+				break
+			}
+		}
+	}
+}
+
+func TestRecMIIMemory(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []string
+		recMII  int
+	}{
+		{
+			// ld, mulu and the store the next iteration loads: 1 + 3 + 1 bundles.
+			name:    "next element",
+			program: []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "mulu x3, x3, x3", "st x3, 8(x2)", "addi x2, x2, 8", "loop 2"},
+			recMII:  5,
+		},
+		{
+			name:    "element two iterations later",
+			program: []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "mulu x3, x3, x3", "st x3, 16(x2)", "addi x2, x2, 8", "loop 2"},
+			recMII:  3,
+		},
+		{
+			name:    "same element",
+			program: []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "mulu x3, x3, x3", "st x3, 0(x2)", "addi x2, x2, 8", "loop 2"},
+			recMII:  1,
+		},
+		{
+			name:    "unknown root",
+			program: []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x4)", "mulu x3, x3, x3", "st x3, 0(x2)", "addi x2, x2, 8", "loop 2"},
+			recMII:  5,
+		},
+	}
+	for _, tt := range tests {
+		deps := programDeps(t, tt.program)
+		lps := newLoopPipScheduler(VLIW470(), mustParse(t, tt.program), deps)
+		body := deps.bb1()[:len(deps.bb1())-1]
+		ops := make([]int, len(body))
+		for i, dep := range body {
+			ops[i] = dep.pc
+		}
+		if got := recMII(ops, lps.bodyEdges(body)); got != tt.recMII {
+			t.Errorf("%s: RecMII is %d, want %d", tt.name, got, tt.recMII)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package scheduler
+
+import "sort"
+
+// budgetRatio bounds the placements of the iterative modulo scheduler, per instruction of the loop body.
+const budgetRatio = 6
+
+// loopEdge is a dependency between two instructions of the loop body, the consumer of an interloop
+// dependency belongs to the next iteration.
+type loopEdge struct {
+	from, to int
+	latency  int
+	distance int
+}
+
+func (lps *loopPipScheduler) bodyEdges(body []dependency) []loopEdge {
+	var edges []loopEdge
+	for _, dep := range body {
+		for _, depPc := range dep.localDeps {
+			edges = append(edges, loopEdge{from: depPc, to: dep.pc, latency: lps.md.latency(lps.instrs[depPc])})
+		}
+		for _, iDep := range dep.interloopDeps {
+			edges = append(edges, loopEdge{from: iDep.body, to: dep.pc, latency: lps.md.latency(lps.instrs[iDep.body]), distance: 1})
+		}
+		for _, depPc := range dep.memoryDeps {
+			if depPc >= lps.deps.bb1Start {
+				edges = append(edges, loopEdge{from: depPc, to: dep.pc, latency: lps.md.memoryLatency(lps.instrs[depPc], lps.instrs[dep.pc])})
+			}
+		}
+		for _, mDep := range dep.interloopMemoryDeps {
+			latency := lps.md.memoryLatency(lps.instrs[mDep.pc], lps.instrs[dep.pc])
+			edges = append(edges, loopEdge{from: mDep.pc, to: dep.pc, latency: latency, distance: mDep.distance})
+		}
+	}
+	return edges
+}
+
+// heights returns the priority of the instructions, the length of the longest path from them to the end
+// of the iteration. It stops relaxing the paths when II is too small for the recurrences.
+func (lps *loopPipScheduler) heights(ops []int, edges []loopEdge, II int) map[int]int {
+	height := make(map[int]int, len(ops))
+	for _, pc := range ops {
+		height[pc] = lps.md.latency(lps.instrs[pc])
+	}
+	for round := 0; round <= len(ops); round++ {
+		changed := false
+		for _, e := range edges {
+			if h := height[e.to] + e.latency - II*e.distance; h > height[e.from] {
+				height[e.from] = h
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return height
+}
+
+// moduloSchedule places the loop body with Rau's iterative modulo scheduling. The instructions are placed by
+// decreasing height in the first bundle that satisfies their scheduled predecessors and has a free slot modulo
+// II. When there is none, an instruction using the slot is evicted, as are the successors whose dependencies
+// become violated, and they are placed again later. It returns the bundle of every instruction relative to the
+// start of bb1, or false when the budget runs out.
+func (lps *loopPipScheduler) moduloSchedule(body []dependency, earliest func(pc int) int, II int) (map[int]int, map[int]bundleSlot, bool) {
+	ops := make([]int, len(body))
+	for i, dep := range body {
+		ops[i] = dep.pc
+	}
+	edges := lps.bodyEdges(body)
+	height := lps.heights(ops, edges, II)
+
+	byPriority := append([]int(nil), ops...)
+	sort.SliceStable(byPriority, func(i, j int) bool {
+		return height[byPriority[i]] > height[byPriority[j]]
+	})
+
+	times := make(map[int]int, len(ops))
+	slots := make(map[int]bundleSlot, len(ops))
+	lastTimes := make(map[int]int, len(ops))
+	mrt := make([]bundle, II)
+
+	evict := func(pc int) {
+		mrt[times[pc]%II][slots[pc]] = nil
+		delete(times, pc)
+		delete(slots, pc)
+	}
+
+	for budget := budgetRatio * len(ops); len(times) < len(ops); budget-- {
+		if budget == 0 {
+			return nil, nil, false
+		}
+
+		pc := -1
+		for _, candidate := range byPriority {
+			if _, scheduled := times[candidate]; !scheduled {
+				pc = candidate
+				break
+			}
+		}
+		sI := &specIns{instr: lps.instrs[pc]}
+
+		estart := earliest(pc)
+		for _, e := range edges {
+			if t, scheduled := times[e.from]; scheduled && e.to == pc {
+				estart = maxInt(estart, t+e.latency-II*e.distance)
+			}
+		}
+
+		time, slot := -1, noSlot
+		for t := estart; t < estart+II && slot == noSlot; t++ {
+			if slot = mrt[t%II].addInst(lps.md, sI); slot != noSlot {
+				time = t
+			}
+		}
+		if slot == noSlot {
+			// Force the instruction in, after its previous place to not repeat the same schedule.
+			time = estart
+			if last, ok := lastTimes[pc]; ok && last >= time {
+				time = last + 1
+			}
+			victim := -1
+			for _, s := range lps.md.slotsOf(sI.instr.type_) {
+				occupant := mrt[time%II][s].instr.pc
+				if victim == -1 || height[occupant] < height[victim] {
+					victim, slot = occupant, s
+				}
+			}
+			evict(victim)
+			mrt[time%II][slot] = sI
+		}
+		times[pc], slots[pc], lastTimes[pc] = time, slot, time
+
+		for _, e := range edges {
+			if t, scheduled := times[e.to]; scheduled && e.from == pc && t < time+e.latency-II*e.distance {
+				evict(e.to)
+			}
+		}
+	}
+	return times, slots, true
+}
+
+// recMII returns the smallest II that satisfies every recurrence of the loop body, the cycles of dependencies
+// whose latency exceeds II times their distance.
+func recMII(ops []int, edges []loopEdge) int {
+	maxII := 1
+	for _, e := range edges {
+		maxII += maxInt(0, e.latency)
+	}
+	for II := 1; II < maxII; II++ {
+		if !hasPositiveCycle(ops, edges, II) {
+			return II
+		}
+	}
+	return maxII
+}
+
+// hasPositiveCycle reports whether a cycle of the dependencies takes longer than the iterations it spans.
+func hasPositiveCycle(ops []int, edges []loopEdge, II int) bool {
+	longest := make(map[int]int, len(ops))
+	for round := 0; round <= len(ops); round++ {
+		changed := false
+		for _, e := range edges {
+			if l := longest[e.from] + e.latency - II*e.distance; l > longest[e.to] {
+				longest[e.to] = l
+				changed = true
+			}
+		}
+		if !changed {
+			return false
+		}
+	}
+	return true
+}
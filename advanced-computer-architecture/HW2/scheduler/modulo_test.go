@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"io"
+	"testing"
+)
+
+func TestModuloScheduleReachesMII(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []string
+		bounds  LoopBounds
+	}{
+		{
+			name:    "memory unit",
+			program: []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "ld x4, 8(x2)", "add x5, x3, x4", "st x5, 16(x2)", "addi x2, x2, 24", "loop 2"},
+			bounds:  LoopBounds{Loop: 7, II: 3, ResMII: 3, RecMII: 1},
+		},
+		{
+			name:    "alu",
+			program: []string{"mov LC, 9", "mov x2, 1", "addi x3, x2, 1", "addi x4, x2, 2", "add x5, x3, x4", "sub x6, x5, x3", "add x7, x6, x4", "addi x2, x2, 1", "loop 2"},
+			bounds:  LoopBounds{Loop: 8, II: 3, ResMII: 3, RecMII: 1},
+		},
+		{
+			name:    "register recurrence",
+			program: []string{"mov LC, 9", "mov x2, 3", "mov x3, 5", "mulu x2, x2, x3", "addi x3, x3, 1", "loop 3", "st x2, 0(x3)"},
+			bounds:  LoopBounds{Loop: 5, II: 3, ResMII: 1, RecMII: 3},
+		},
+		{
+			name:    "long register recurrence",
+			program: []string{"mov LC, 9", "mov x2, 3", "mulu x3, x2, x2", "addi x2, x3, 1", "loop 2", "st x2, 0(x0)"},
+			bounds:  LoopBounds{Loop: 4, II: 4, ResMII: 1, RecMII: 4},
+		},
+		{
+			name:    "memory recurrence",
+			program: []string{"mov LC, 9", "mov x2, 4096", "ld x3, 0(x2)", "mulu x3, x3, x3", "st x3, 8(x2)", "addi x2, x2, 8", "loop 2"},
+			bounds:  LoopBounds{Loop: 6, II: 5, ResMII: 2, RecMII: 5},
+		},
+	}
+	for _, tt := range tests {
+		s := New()
+		s.SetVerify(true)
+		if err := s.Schedule(tt.program, io.Discard, io.Discard); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		bounds := s.LoopBounds()
+		if len(bounds) != 1 {
+			t.Errorf("%s: %d loops have bounds, want 1", tt.name, len(bounds))
+			continue
+		}
+		if b := bounds[0]; b.II != maxInt(b.ResMII, b.RecMII) {
+			t.Errorf("%s: %v does not reach the lower bound", tt.name, b)
+		}
+		if bounds[0] != tt.bounds {
+			t.Errorf("%s: loop bounds are %v, want %v", tt.name, bounds[0], tt.bounds)
+		}
+	}
+}
@@ -39,10 +39,10 @@ func parseReg(op string) (reg, error) {
 		return reg{}, fmt.Errorf("invalid register: %s", op)
 	}
 	regNum, err := strconv.ParseUint(op[1:], 10, 8)
-	if err != nil || regNum > 95 {
+	if err != nil {
 		return reg{}, fmt.Errorf("invalid register: %s", op)
 	}
-	res.num = uint8(regNum)
+	res.num = int(regNum)
 	return res, nil
 }
 
@@ -88,8 +88,10 @@ func parseInstruction(asm string) (ins instruction, err error) {
 	split := strings.Fields(asm)
 	if len(split) != 0 {
 		parts = append(parts, split[0])
-		operands := strings.Split(strings.Join(split[1:], ""), ",")
-		parts = append(parts, operands...)
+		if len(split) > 1 {
+			operands := strings.Split(strings.Join(split[1:], ""), ",")
+			parts = append(parts, operands...)
+		}
 	}
 	if len(parts) == 0 {
 		return ins, fmt.Errorf("malformed instruction: %s", asm)
@@ -0,0 +1,426 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+)
+
+// sectionScheduler schedules a section of a program, an innermost loop with the basic blocks around it or basic
+// blocks only, and leaves its registers virtual.
+type sectionScheduler interface {
+	scheduleSection() (*blockBundles, error)
+}
+
+// section is a range of the program scheduled at once, it has at most one loop. The outer loops are sections
+// too, laid out around the sections of their body.
+type section struct {
+	start, end int
+	loop       *region
+}
+
+// programScheduler schedules the programs that are not a section. Every section is scheduled as a program of its
+// own, and the sections follow each other in the bundles. The values go from a section to the next in virtual
+// registers, assigned to the registers of the machine once the whole program is laid out.
+type programScheduler struct {
+	md         *MachineDescription
+	instrs     []instruction
+	deps       sectionDeps
+	newSection func(instrs []instruction, deps sectionDeps) sectionScheduler
+	// copyLiveOut copies the values of the loops read after their section to static registers, the following
+	// pipelined loops rotate the registers.
+	copyLiveOut bool
+
+	bundles []bundle
+	// landing is the first bundle by which every instruction laid out has written its result.
+	landing int
+	// names are the virtual registers holding the registers of the input program, nextName is the first unused.
+	names    map[reg]int
+	nextName int
+	// reads are the virtual registers read by the sections from the earlier ones, in order.
+	reads []int
+}
+
+func newProgramScheduler(md *MachineDescription, instrs []instruction, deps sectionDeps,
+	newSection func(instrs []instruction, deps sectionDeps) sectionScheduler) *programScheduler {
+	return &programScheduler{
+		md:         md,
+		instrs:     instrs,
+		deps:       deps,
+		newSection: newSection,
+		names:      make(map[reg]int),
+		nextName:   virtualReg,
+	}
+}
+
+// schedule lays the program out, its registers stay virtual.
+func (ps *programScheduler) schedule() (*blockBundles, error) {
+	if err := ps.layout(ps.deps.regions); err != nil {
+		return nil, err
+	}
+	return &blockBundles{md: ps.md, bb0: ps.bundles}, nil
+}
+
+// sections groups the regions, the basic blocks go with the following innermost loop and the last ones with the
+// loop before them.
+func sections(regions []region) []section {
+	var res []section
+	start := regions[0].start
+	for i, r := range regions {
+		if !r.loop {
+			continue
+		}
+		if r.innermost() {
+			res = append(res, section{start: start, end: r.end, loop: &regions[i]})
+		} else {
+			if start < r.start {
+				res = append(res, section{start: start, end: r.start})
+			}
+			res = append(res, section{start: r.start, end: r.end, loop: &regions[i]})
+		}
+		start = r.end
+	}
+
+	if end := regions[len(regions)-1].end; start < end {
+		if last := len(res) - 1; last >= 0 && res[last].loop.innermost() {
+			res[last].end = end
+		} else {
+			res = append(res, section{start: start, end: end})
+		}
+	}
+	return res
+}
+
+func (ps *programScheduler) layout(regions []region) error {
+	for _, sec := range sections(regions) {
+		var err error
+		if sec.loop != nil && !sec.loop.innermost() {
+			err = ps.layoutLoop(*sec.loop)
+		} else {
+			err = ps.layoutSection(sec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *programScheduler) layoutSection(sec section) error {
+	instrs, pcs := ps.sectionInstrs(sec)
+	regions, err := splitIntoRegions(instrs)
+	if err != nil {
+		return err
+	}
+	deps := getDependencies(instrs, regions)
+	bundles, err := ps.newSection(instrs, deps).scheduleSection()
+	if err != nil {
+		return err
+	}
+
+	ps.connect(bundles, instrs, deps, pcs)
+	ps.pad()
+	offset := len(ps.bundles)
+	for idx, b := range bundles.all() {
+		if branch := b[ps.md.branch]; branch != nil {
+			branch.instr.imm += int64(offset)
+		}
+		ps.bundles = append(ps.bundles, b)
+		ps.land(offset + idx)
+	}
+	return nil
+}
+
+// layoutLoop lays out the body of an outer loop, the values its next iteration reads from before the loop are
+// copied from the ones of the end of the body.
+func (ps *programScheduler) layoutLoop(l region) error {
+	ps.pad()
+	start := len(ps.bundles)
+	entry := make(map[reg]int, len(ps.names))
+	for r, name := range ps.names {
+		entry[r] = name
+	}
+	firstRead := len(ps.reads)
+
+	if err := ps.layout(l.body); err != nil {
+		return err
+	}
+
+	read := make(map[int]bool)
+	for _, name := range ps.reads[firstRead:] {
+		read[name] = true
+	}
+	var copies []*specIns
+	for _, r := range sortedRegs(entry) {
+		if name := entry[r]; read[name] && ps.names[r] != name {
+			copies = append(copies, &specIns{instr: instruction{
+				pc:      -1,
+				type_:   mov,
+				regA:    reg{type_: xReg, num: name},
+				regB:    reg{type_: xReg, num: ps.names[r]},
+				usesReg: true,
+			}})
+		}
+	}
+
+	branchIdx := len(ps.bundles) - 1
+	// The stores land before the body starts again, for its loads.
+	for idx := start; idx < len(ps.bundles); idx++ {
+		for _, sI := range ps.bundles[idx] {
+			if sI != nil && sI.instr.type_ == st {
+				branchIdx = maxInt(branchIdx, idx+ps.md.latency(sI.instr)-1)
+			}
+		}
+	}
+	if len(copies) != 0 {
+		idx := ps.landing
+		ps.extend(idx + 1)
+		for _, sI := range copies {
+			for ps.bundles[idx].addInst(ps.md, sI) == noSlot {
+				idx++
+				ps.extend(idx + 1)
+			}
+			// The copies land before the body starts again.
+			branchIdx = maxInt(branchIdx, idx+ps.md.latency(sI.instr)-1)
+		}
+	}
+	for ps.extend(branchIdx + 1); ps.bundles[branchIdx][ps.md.branch] != nil; branchIdx++ {
+		ps.extend(branchIdx + 2)
+	}
+	ps.bundles[branchIdx][ps.md.branch] = &specIns{
+		pred: nil,
+		instr: instruction{
+			pc:    l.end - 1,
+			type_: loop,
+			imm:   int64(start),
+		},
+	}
+	for idx := start; idx < len(ps.bundles); idx++ {
+		ps.land(idx)
+	}
+	return nil
+}
+
+// sectionInstrs returns the instructions of the section numbered from 0, with the copies of the registers the
+// loop carries from before the section and, with copyLiveOut, of the ones it writes for after it. It returns
+// the pcs of the instructions in the program too, -1 for the copies.
+func (ps *programScheduler) sectionInstrs(sec section) ([]instruction, []int) {
+	var instrs []instruction
+	var pcs []int
+	add := func(instr instruction, pc int) {
+		instr.pc = len(instrs)
+		instrs = append(instrs, instr)
+		pcs = append(pcs, pc)
+	}
+	copyOf := func(r reg) instruction {
+		return instruction{type_: mov, regA: r, regB: r, usesReg: true}
+	}
+
+	if sec.loop == nil {
+		for pc := sec.start; pc < sec.end; pc++ {
+			add(ps.instrs[pc], pc)
+		}
+		return instrs, pcs
+	}
+
+	l := sec.loop
+	for pc := sec.start; pc < l.start; pc++ {
+		add(ps.instrs[pc], pc)
+	}
+	carriedIn := make(map[reg]int)
+	for _, dep := range ps.deps.deps[l.start:l.end] {
+		for r, iDep := range dep.interloopDeps {
+			if iDep.init < sec.start && iDep.body >= l.start && iDep.body < l.end {
+				carriedIn[r] = iDep.init
+			}
+		}
+	}
+	for _, r := range sortedRegs(carriedIn) {
+		add(copyOf(r), -1)
+	}
+
+	bb1Start := len(instrs)
+	for pc := l.start; pc < l.end; pc++ {
+		add(ps.instrs[pc], pc)
+	}
+	instrs[len(instrs)-1].imm = int64(bb1Start)
+
+	if ps.copyLiveOut {
+		for _, r := range sortedRegs(ps.liveOut(sec)) {
+			add(copyOf(r), -1)
+		}
+	}
+	for pc := l.end; pc < sec.end; pc++ {
+		add(ps.instrs[pc], pc)
+	}
+	return instrs, pcs
+}
+
+// liveOut returns the registers last written by the loop of the section that the program reads out of the loop
+// and the instructions after it.
+func (ps *programScheduler) liveOut(sec section) map[reg]int {
+	written := make(map[reg]int)
+	for pc := sec.loop.start; pc < sec.end; pc++ {
+		if dst, _ := ps.instrs[pc].regs(); dst != nil && dst.type_ == xReg {
+			written[*dst] = pc
+		}
+	}
+	liveOut := make(map[reg]int)
+	for pc, instr := range ps.instrs {
+		if pc >= sec.loop.start && pc < sec.end {
+			continue
+		}
+		_, ops := instr.regs()
+		for _, op := range ops {
+			if last, ok := written[op]; ok && last < sec.loop.end {
+				liveOut[op] = last
+			}
+		}
+	}
+	return liveOut
+}
+
+// connect gives the section virtual registers of its own, the registers it reads from the earlier sections the
+// names of their values, and the instructions their pcs in the program.
+func (ps *programScheduler) connect(bundles *blockBundles, instrs []instruction, deps sectionDeps, pcs []int) {
+	scheduled := make([]*specIns, len(instrs))
+	maxName := ps.nextName - 1
+	for _, b := range bundles.all() {
+		for _, sI := range b {
+			if sI == nil {
+				continue
+			}
+			if sI.instr.pc != -1 {
+				scheduled[sI.instr.pc] = sI
+			}
+			dst, ops := sI.instr.mutRegs()
+			if dst != nil {
+				ops = append(ops, dst)
+			}
+			for _, r := range ops {
+				if isVirtual(*r) {
+					r.num += ps.nextName - virtualReg
+					maxName = maxInt(maxName, r.num)
+				}
+			}
+		}
+	}
+	ps.nextName = maxName + 1
+
+	for pc, sI := range scheduled {
+		_, inputOps := instrs[pc].regs()
+		_, ops := sI.instr.mutRegs()
+		for i, op := range inputOps {
+			if name, ok := ps.names[op]; ok && op.type_ == xReg && !deps.deps[pc].dependsOn(op) {
+				ops[i].num = name
+				ps.reads = append(ps.reads, name)
+			}
+		}
+	}
+
+	for pc, sI := range scheduled {
+		if dst, _ := instrs[pc].regs(); dst != nil && dst.type_ == xReg {
+			ps.names[*dst] = sI.instr.regA.num
+		}
+		sI.instr.pc = pcs[pc]
+	}
+}
+
+// pad adds empty bundles until every instruction laid out has written its result.
+func (ps *programScheduler) pad() {
+	ps.extend(ps.landing)
+}
+
+func (ps *programScheduler) extend(length int) {
+	for len(ps.bundles) < length {
+		ps.bundles = append(ps.bundles, bundle{})
+	}
+}
+
+func (ps *programScheduler) land(idx int) {
+	for _, sI := range ps.bundles[idx] {
+		if sI != nil && sI.instr.type_ != nop {
+			ps.landing = maxInt(ps.landing, idx+ps.md.latency(sI.instr))
+		}
+	}
+}
+
+func sortedRegs(regs map[reg]int) []reg {
+	sorted := make([]reg, 0, len(regs))
+	for r := range regs {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].num < sorted[j].num })
+	return sorted
+}
+
+// scheduleLoop schedules the program without pipelining its loops.
+func (s *Scheduler) scheduleLoop(instrs []instruction, deps sectionDeps) (*blockBundles, error) {
+	if deps.isSection() {
+		return newLoopScheduler(s.md, instrs, deps).schedule()
+	}
+
+	bundles, err := newProgramScheduler(s.md, instrs, deps, func(instrs []instruction, deps sectionDeps) sectionScheduler {
+		return newLoopScheduler(s.md, instrs, deps)
+	}).schedule()
+	if err != nil {
+		return nil, err
+	}
+	if !bundles.assignRegisters(s.md.Registers.size()) {
+		return nil, fmt.Errorf("loop needs more than the %d registers of the machine", s.md.Registers.size())
+	}
+	return bundles, nil
+}
+
+// scheduleLoopPip schedules the program pipelining its innermost loops, the outer ones are not.
+func (s *Scheduler) scheduleLoopPip(instrs []instruction, deps sectionDeps) (*blockBundles, error) {
+	if deps.isSection() {
+		lps := newLoopPipScheduler(s.md, instrs, deps)
+		bundles, err := lps.schedule()
+		s.loopBounds = nil
+		if lps.bounds.II != 0 {
+			lps.bounds.Loop = deps.bb2Start - 1
+			s.loopBounds = append(s.loopBounds, lps.bounds)
+		}
+		return bundles, err
+	}
+
+	var pipelined []*loopPipScheduler
+	ps := newProgramScheduler(s.md, instrs, deps, func(instrs []instruction, deps sectionDeps) sectionScheduler {
+		lps := newLoopPipScheduler(s.md, instrs, deps)
+		lps.clearPredicates = true
+		pipelined = append(pipelined, lps)
+		return lps
+	})
+	ps.copyLiveOut = true
+	bundles, err := ps.schedule()
+	if err != nil {
+		return nil, err
+	}
+	// The sections with a loop are laid out in the order of their loops.
+	loops := innermostLoops(deps.regions)
+	s.loopBounds = nil
+	for _, lps := range pipelined {
+		if lps.bounds.II != 0 {
+			lps.bounds.Loop = loops[len(s.loopBounds)]
+			s.loopBounds = append(s.loopBounds, lps.bounds)
+		}
+	}
+	if !bundles.assignRegisters(s.md.Registers.Static) {
+		return nil, fmt.Errorf("loop.pip needs more than the %d static registers of the machine", s.md.Registers.Static)
+	}
+	return bundles, nil
+}
+
+// innermostLoops returns the loop instructions of the innermost loops, in the order of the program.
+func innermostLoops(regions []region) []int {
+	var loops []int
+	for _, r := range regions {
+		switch {
+		case r.innermost():
+			loops = append(loops, r.end-1)
+		case r.loop:
+			loops = append(loops, innermostLoops(r.body)...)
+		}
+	}
+	return loops
+}
@@ -0,0 +1,355 @@
+package scheduler
+
+// virtualReg is the first name of the registers allocated for reuse, assignRegisters maps them to the
+// registers of the machine once the schedule is final.
+const virtualReg = 1 << 16
+
+// spillAddress is the start of the memory the spilled registers are stored to, the programs are expected
+// to stay below it.
+const spillAddress uint64 = 1 << 62
+
+type regSet map[int]struct{}
+
+func isVirtual(r reg) bool {
+	return r.type_ == xReg && r.num >= virtualReg
+}
+
+func (bb *blockBundles) clone() *blockBundles {
+	cloneBlock := func(block []bundle) []bundle {
+		res := make([]bundle, len(block))
+		for i, b := range block {
+			for slot, sI := range b {
+				if sI != nil {
+					c := *sI
+					res[i][slot] = &c
+				}
+			}
+		}
+		return res
+	}
+	return &blockBundles{md: bb.md, bb0: cloneBlock(bb.bb0), bb1: cloneBlock(bb.bb1), bb2: cloneBlock(bb.bb2)}
+}
+
+// retargetBranches points the branches to the start of bb1, after bundles were added before it.
+func (bb *blockBundles) retargetBranches() {
+	for i := 0; i < bb.len(); i++ {
+		b := bb.get(i)
+		if b[bb.md.branch] != nil {
+			b[bb.md.branch].instr.imm = int64(bb.bb1Start())
+		}
+	}
+}
+
+func (bb *blockBundles) successors(idx int) []int {
+	var succs []int
+	if idx+1 < bb.len() {
+		succs = append(succs, idx+1)
+	}
+	if branch := bb.get(idx)[bb.md.branch]; branch != nil {
+		succs = append(succs, int(branch.instr.imm))
+	}
+	return succs
+}
+
+// liveness returns the virtual registers live at the issue of every bundle, and the ones that must keep their
+// register past it because they are read later or a write to them is still in flight.
+func (bb *blockBundles) liveness() (in, out []regSet) {
+	n := bb.len()
+	uses, defs := make([]regSet, n), make([]regSet, n)
+	in, out = make([]regSet, n), make([]regSet, n)
+	for idx := 0; idx < n; idx++ {
+		uses[idx], defs[idx], in[idx], out[idx] = regSet{}, regSet{}, regSet{}, regSet{}
+		for _, sI := range bb.get(idx) {
+			if sI == nil {
+				continue
+			}
+			dst, ops := sI.instr.regs()
+			for _, op := range ops {
+				if isVirtual(op) {
+					uses[idx][op.num] = struct{}{}
+				}
+			}
+			// A predicated write may not happen, it does not end the previous value.
+			if dst != nil && isVirtual(*dst) && sI.pred == nil {
+				defs[idx][dst.num] = struct{}{}
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for idx := n - 1; idx >= 0; idx-- {
+			for _, succ := range bb.successors(idx) {
+				for r := range in[succ] {
+					out[idx][r] = struct{}{}
+				}
+			}
+			live := len(in[idx])
+			for r := range uses[idx] {
+				in[idx][r] = struct{}{}
+			}
+			for r := range out[idx] {
+				if _, killed := defs[idx][r]; !killed {
+					in[idx][r] = struct{}{}
+				}
+			}
+			changed = changed || len(in[idx]) != live
+		}
+	}
+
+	// The writes land latency bundles after their issue, along every path.
+	for idx := 0; idx < n; idx++ {
+		for _, sI := range bb.get(idx) {
+			if sI == nil {
+				continue
+			}
+			dst, _ := sI.instr.regs()
+			if dst == nil || !isVirtual(*dst) {
+				continue
+			}
+			frontier := []int{idx}
+			for step := 0; step < bb.md.latency(sI.instr); step++ {
+				var next []int
+				for _, i := range frontier {
+					out[i][dst.num] = struct{}{}
+					next = append(next, bb.successors(i)...)
+				}
+				frontier = next
+			}
+		}
+	}
+	return in, out
+}
+
+// virtualRegs returns the virtual registers by first appearance.
+func (bb *blockBundles) virtualRegs() []int {
+	var names []int
+	seen := regSet{}
+	for idx := 0; idx < bb.len(); idx++ {
+		for _, sI := range bb.get(idx) {
+			if sI == nil {
+				continue
+			}
+			dst, ops := sI.instr.regs()
+			if dst != nil {
+				ops = append(ops, *dst)
+			}
+			for _, r := range ops {
+				if _, ok := seen[r.num]; isVirtual(r) && !ok {
+					seen[r.num] = struct{}{}
+					names = append(names, r.num)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// colorRegisters gives every virtual register one of the registers 1 to limit-1, the ones live at the same point
+// get different registers. It fails when a register has no free one left.
+func colorRegisters(names []int, points []regSet, limit int) (map[int]int, bool) {
+	interferes := make(map[int]regSet, len(names))
+	for _, name := range names {
+		interferes[name] = regSet{}
+	}
+	for _, point := range points {
+		for a := range point {
+			for b := range point {
+				if a != b {
+					interferes[a][b] = struct{}{}
+				}
+			}
+		}
+	}
+
+	colors := make(map[int]int, len(names))
+	for _, name := range names {
+		taken := make(map[int]bool)
+		for other := range interferes[name] {
+			if color, ok := colors[other]; ok {
+				taken[color] = true
+			}
+		}
+		color := 1
+		for taken[color] {
+			color++
+		}
+		if color >= limit {
+			return nil, false
+		}
+		colors[name] = color
+	}
+	return colors, true
+}
+
+// assignRegisters maps the virtual registers to the registers 1 to limit-1. When they do not fit, it spills the
+// registers of bb0 only read in bb2 to memory, so they are not kept through the loop, until they do.
+func (bb *blockBundles) assignRegisters(limit int) bool {
+	for spills := 0; ; spills++ {
+		in, out := bb.liveness()
+		if colors, ok := colorRegisters(bb.virtualRegs(), append(in, out...), limit); ok {
+			bb.renameRegisters(colors)
+			return true
+		}
+		if !bb.spillRegister(append(in, out...), spills) {
+			return false
+		}
+	}
+}
+
+func (bb *blockBundles) renameRegisters(colors map[int]int) {
+	for idx := 0; idx < bb.len(); idx++ {
+		for _, sI := range bb.get(idx) {
+			if sI == nil {
+				continue
+			}
+			dst, ops := sI.instr.mutRegs()
+			if dst != nil {
+				ops = append(ops, dst)
+			}
+			for _, r := range ops {
+				if isVirtual(*r) {
+					r.num = colors[r.num]
+				}
+			}
+		}
+	}
+}
+
+// spillRegister stores the longest lived register written once in bb0 and only read in bb2 to the spill slot,
+// and loads it back after the loop. Both sides get the slot address in a register of their own.
+func (bb *blockBundles) spillRegister(points []regSet, slot int) bool {
+	type occurrences struct {
+		defs, reads []int
+		def         *specIns
+	}
+	occs := make(map[int]*occurrences)
+	for idx := 0; idx < bb.len(); idx++ {
+		for _, sI := range bb.get(idx) {
+			if sI == nil {
+				continue
+			}
+			dst, ops := sI.instr.regs()
+			for _, op := range ops {
+				if isVirtual(op) {
+					if occs[op.num] == nil {
+						occs[op.num] = &occurrences{}
+					}
+					occs[op.num].reads = append(occs[op.num].reads, idx)
+				}
+			}
+			if dst != nil && isVirtual(*dst) {
+				if occs[dst.num] == nil {
+					occs[dst.num] = &occurrences{}
+				}
+				occs[dst.num].defs = append(occs[dst.num].defs, idx)
+				occs[dst.num].def = sI
+			}
+		}
+	}
+
+	lifetime := make(map[int]int)
+	for _, point := range points {
+		for r := range point {
+			lifetime[r]++
+		}
+	}
+
+	spilled := -1
+	for r, occ := range occs {
+		if len(occ.defs) != 1 || occ.def.pred != nil || occ.defs[0] >= bb.bb1Start() || len(occ.reads) == 0 {
+			continue
+		}
+		if occ.reads[0] < bb.bb2Start() {
+			continue
+		}
+		if spilled == -1 || lifetime[r] > lifetime[spilled] || (lifetime[r] == lifetime[spilled] && r < spilled) {
+			spilled = r
+		}
+	}
+	if spilled == -1 {
+		return false
+	}
+
+	next := virtualReg
+	for r := range occs {
+		next = maxInt(next, r+1)
+	}
+	address := int64(spillAddress) + int64(slot)
+	movLatency := bb.md.latency(instruction{type_: mov})
+	ldLatency := bb.md.latency(instruction{type_: ld})
+
+	// Store as soon as the write lands and load right before the first read, adding bundles for them when needed.
+	def := occs[spilled].def
+	defIdx := occs[spilled].defs[0]
+	bb0Length := len(bb.bb0)
+	for placed := false; !placed; {
+		land := defIdx + bb.md.latency(def.instr)
+		for memIdx := land; memIdx <= land+movLatency && memIdx < bb.bb1Start() && !placed; memIdx++ {
+			placed = bb.placePair(bb.spillInstr(mov, next, spilled, address), bb.spillInstr(st, next, spilled, address),
+				memIdx, bb.bb0Start(), movLatency)
+		}
+		if !placed {
+			bb.insertBundle(minInt(land, bb.bb1Start()))
+		}
+	}
+
+	firstRead := occs[spilled].reads[0] + len(bb.bb0) - bb0Length
+	for !bb.placePair(bb.spillInstr(mov, next+1, next+1, address), bb.spillInstr(ld, next+1, next+1, address),
+		firstRead-ldLatency, bb.bb2Start(), movLatency) {
+		bb.insertBundle(firstRead)
+		firstRead++
+	}
+
+	for idx := bb.bb2Start(); idx < bb.len(); idx++ {
+		for _, sI := range bb.get(idx) {
+			if sI == nil {
+				continue
+			}
+			_, ops := sI.instr.mutRegs()
+			for _, op := range ops {
+				if isVirtual(*op) && op.num == spilled {
+					op.num = next + 1
+				}
+			}
+		}
+	}
+	return true
+}
+
+// spillInstr returns the instruction of the spill code, base holds the address of the slot and value is the
+// register stored or loaded.
+func (bb *blockBundles) spillInstr(it instructionType, base int, value int, address int64) *specIns {
+	sI := &specIns{instr: instruction{pc: -1, type_: it, regA: reg{type_: xReg, num: value}}}
+	switch it {
+	case mov:
+		sI.instr.regA.num, sI.instr.imm = base, address
+	case ld, st:
+		sI.instr.regB = reg{type_: xReg, num: base}
+	}
+	return sI
+}
+
+// placePair places the memory access in the bundle, and the mov of its address latency bundles before, in the
+// block.
+func (bb *blockBundles) placePair(movI, memI *specIns, memIdx, blockStart, latency int) bool {
+	movIdx := memIdx - latency
+	if movIdx < blockStart || !bb.get(memIdx).hasSlot(bb.md, memI.instr.type_) || !bb.get(movIdx).hasSlot(bb.md, mov) {
+		return false
+	}
+	bb.get(movIdx).addInst(bb.md, movI)
+	bb.get(memIdx).addInst(bb.md, memI)
+	return true
+}
+
+// insertBundle adds an empty bundle at the index, the following bundles of bb0 or bb2 are delayed by one.
+func (bb *blockBundles) insertBundle(idx int) {
+	block, start := &bb.bb0, bb.bb0Start()
+	if idx > bb.bb1Start() {
+		block, start = &bb.bb2, bb.bb2Start()
+	}
+	*block = append(*block, bundle{})
+	copy((*block)[idx-start+1:], (*block)[idx-start:])
+	(*block)[idx-start] = bundle{}
+	bb.retargetBranches()
+}
@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpillRegisters(t *testing.T) {
+	// Values kept through the loop, more than the registers of the machine hold at once.
+	program := []string{"mov LC, 9", "mov x31, 4096"}
+	for r := 1; r <= 20; r++ {
+		program = append(program, fmt.Sprintf("mov x%d, %d", r, r))
+	}
+	for r := 21; r <= 30; r++ {
+		program = append(program, fmt.Sprintf("mov x%d, 0", r))
+	}
+	start := len(program)
+	for r := 21; r <= 30; r++ {
+		program = append(program, fmt.Sprintf("addi x%d, x%d, %d", r, r, r))
+	}
+	program = append(program, fmt.Sprintf("loop %d", start))
+	for r := 1; r <= 30; r++ {
+		program = append(program, fmt.Sprintf("st x%d, %d(x31)", r, 8*r))
+	}
+
+	instrs := mustParse(t, program)
+	deps := programDeps(t, program)
+
+	tests := []struct {
+		name      string
+		registers RegisterFile
+		schedule  func(md *MachineDescription) (*blockBundles, error)
+	}{
+		{
+			name:      "loop",
+			registers: RegisterFile{Static: 16, Rotating: 16},
+			schedule: func(md *MachineDescription) (*blockBundles, error) {
+				return newLoopScheduler(md, instrs, deps).schedule()
+			},
+		},
+		{
+			name:      "loop.pip",
+			registers: RegisterFile{Static: 16, Rotating: 32},
+			schedule: func(md *MachineDescription) (*blockBundles, error) {
+				return newLoopPipScheduler(md, instrs, deps).schedule()
+			},
+		},
+	}
+	for _, tt := range tests {
+		md := VLIW470()
+		md.Registers = tt.registers
+		bundles, err := tt.schedule(md)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		fills := 0
+		for _, b := range bundles.bb2 {
+			for _, sI := range b {
+				if sI != nil && sI.instr.pc == -1 && sI.instr.type_ == ld {
+					fills++
+				}
+			}
+		}
+		if fills == 0 {
+			t.Errorf("%s: no register is loaded back from a spill slot after the loop", tt.name)
+		}
+		if err = New().verifySchedule(tt.name, instrs, deps, bundles); err != nil {
+			t.Error(err)
+		}
+	}
+}
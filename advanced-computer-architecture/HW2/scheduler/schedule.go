@@ -32,13 +32,13 @@ const (
 )
 
 const (
-	lcReg uint8 = iota
+	lcReg = iota
 	ecReg
 )
 
 type reg struct {
 	type_ regType
-	num   uint8
+	num   int
 }
 
 type instruction struct {
@@ -58,6 +58,38 @@ type specIns struct {
 }
 
 type Scheduler struct {
+	md         *MachineDescription
+	verify     bool
+	dot        io.Writer
+	loopBounds []LoopBounds
+}
+
+// LoopBounds are the initiation intervals of a pipelined loop, II is the one reached and the others are the
+// lower bounds set by the resources and by the recurrences. Loop is the loop instruction in the input program.
+type LoopBounds struct {
+	Loop   int
+	II     int
+	ResMII int
+	RecMII int
+}
+
+// String names what limits the II, the scheduler when it could not reach the larger lower bound.
+func (b LoopBounds) String() string {
+	limit := "resource-limited"
+	switch {
+	case b.II > maxInt(b.ResMII, b.RecMII):
+		limit = "scheduler-limited"
+	case b.RecMII == b.ResMII:
+		limit = "resource- and recurrence-limited"
+	case b.RecMII > b.ResMII:
+		limit = "recurrence-limited"
+	}
+	return fmt.Sprintf("II %d, ResMII %d, RecMII %d, %s", b.II, b.ResMII, b.RecMII, limit)
+}
+
+// LoopBounds returns the initiation intervals of the pipelined loops, in the order of the program.
+func (s *Scheduler) LoopBounds() []LoopBounds {
+	return s.loopBounds
 }
 
 type dependency struct {
@@ -67,6 +99,10 @@ type dependency struct {
 	interloopDeps     map[reg]struct{ init, body int }
 	loopInvariantDeps map[reg]int
 	postLoopDeps      map[reg]int
+	// Earlier loads and stores that may access the address of a load or store, one of the two being a store, and
+	// the ones of the loop body that may access it in an earlier iteration.
+	memoryDeps          []int
+	interloopMemoryDeps []memoryDep
 }
 
 func (d dependency) nonInterloopBodyDeps() map[reg]int {
@@ -86,10 +122,22 @@ func (d dependency) nonInterloopBodyDeps() map[reg]int {
 	return deps
 }
 
+// sectionDeps are the dependencies of the instructions of a program. A program with a single loop, nested in no
+// other, is a section: its loop body bb1 starts at bb1Start and the instructions after it, bb2, at bb2Start.
 type sectionDeps struct {
 	deps     []dependency
+	regions  []region
 	bb1Start int
 	bb2Start int
+	// Registers read in a loop before it writes them, with no write before the loop.
+	carriedOnly []carriedRead
+}
+
+// carriedRead is a read of a register at pc that the loop starting at loopStart carries from the write at body of
+// its previous iteration, its first iteration reads the value from before the program.
+type carriedRead struct {
+	r                   reg
+	pc, body, loopStart int
 }
 
 func (sd sectionDeps) bb0() []dependency {
@@ -104,6 +152,20 @@ func (sd sectionDeps) bb2() []dependency {
 	return sd.deps[sd.bb2Start:]
 }
 
+// isSection reports whether the program has at most one loop, without nested loops.
+func (sd sectionDeps) isSection() bool {
+	loops := 0
+	for _, r := range sd.regions {
+		if r.loop {
+			if !r.innermost() {
+				return false
+			}
+			loops++
+		}
+	}
+	return loops <= 1
+}
+
 func newDependency() dependency {
 	return dependency{
 		localDeps:         make(map[reg]int),
@@ -113,110 +175,133 @@ func newDependency() dependency {
 	}
 }
 
-func (s *Scheduler) getDependencies(b blockInstrs) (deps sectionDeps) {
-	// Find deps in bb0.
-	bb0Regs := make(map[reg]int)
-
-	for _, instr := range b.bb0 {
-		dep := newDependency()
-		dst, ops := instr.regs()
+// getDependencies finds the instructions writing the registers every instruction reads. The loops run at least
+// once, so the last write before an instruction in the program reaches it, and a loop carries the last write of
+// its body to the instructions of the next iteration reading the register before writing it.
+func getDependencies(instrs []instruction, regions []region) (deps sectionDeps) {
+	deps.regions = regions
+	deps.bb1Start, deps.bb2Start = len(instrs), len(instrs)
+	for _, r := range regions {
+		if r.loop {
+			deps.bb1Start, deps.bb2Start = r.start, r.end
+		}
+	}
 
-		for _, op := range ops {
-			if opDep, ok := bb0Regs[op]; ok {
-				dep.localDeps[op] = opDep
-			} else {
-				// Operand not used previously.
+	// The basic block of every instruction, -1 for the loop instructions, and the loops around it, innermost first.
+	blocks := make([]int, len(instrs))
+	loops := make([][]region, len(instrs))
+	numBlocks := 0
+	var walk func(regions []region, outer []region)
+	walk = func(regions []region, outer []region) {
+		for _, r := range regions {
+			if !r.loop {
+				for pc := r.start; pc < r.end; pc++ {
+					blocks[pc], loops[pc] = numBlocks, outer
+				}
+				numBlocks++
+				continue
 			}
+			inner := append([]region{r}, outer...)
+			walk(r.body, inner)
+			blocks[r.end-1], loops[r.end-1] = -1, inner
 		}
+	}
+	walk(regions, nil)
 
-		if dst != nil {
-			bb0Regs[*dst] = instr.pc
+	// lastWrite returns the last instruction of [from, to) writing the register, -1 without one.
+	lastWrite := func(r reg, from, to int) int {
+		for pc := to - 1; pc >= from; pc-- {
+			if dst, _ := instrs[pc].regs(); dst != nil && *dst == r {
+				return pc
+			}
 		}
-
-		dep.pc = len(deps.deps)
-		deps.deps = append(deps.deps, dep)
+		return -1
 	}
-	deps.bb1Start = len(deps.deps)
 
-	// Find non-local deps in bb1.
-	bb1Regs := make(map[reg]int)
-	bb0RegsUsed := make(map[reg]bool)
-	for _, instr := range b.bb1 {
+	for pc, instr := range instrs {
 		dep := newDependency()
-		dst, ops := instr.regs()
+		_, ops := instr.regs()
 
 		for _, op := range ops {
-			if bb1Dep, ok := bb1Regs[op]; ok {
-				dep.localDeps[op] = bb1Dep
-			} else {
-				bb0RegsUsed[op] = true
+			prev := lastWrite(op, 0, pc)
+			carried, carrier := -1, region{}
+			for _, l := range loops[pc] {
+				if lastWrite(op, l.start, pc) != -1 {
+					break
+				}
+				if carried = lastWrite(op, pc, l.end); carried != -1 {
+					carrier = l
+					break
+				}
 			}
-		}
 
-		if dst != nil {
-			bb1Regs[*dst] = instr.pc
+			switch {
+			case carried != -1 && prev != -1:
+				dep.interloopDeps[op] = struct{ init, body int }{prev, carried}
+			case carried != -1:
+				// Assigned in previous loop pass only, the first iteration reads the register before the program.
+				deps.carriedOnly = append(deps.carriedOnly, carriedRead{r: op, pc: pc, body: carried, loopStart: carrier.start})
+			case prev == -1:
+				// Operand not used previously.
+			case blocks[prev] == blocks[pc]:
+				dep.localDeps[op] = prev
+			case endsBefore(loops[prev], pc):
+				dep.postLoopDeps[op] = prev
+			default:
+				dep.loopInvariantDeps[op] = prev
+			}
 		}
 
-		dep.pc = len(deps.deps)
+		dep.pc = pc
 		deps.deps = append(deps.deps, dep)
 	}
 
-	// Remove keys overwritten immediately by bb1.
-	for key := range bb0Regs {
-		if !bb0RegsUsed[key] {
-			delete(bb0Regs, key)
+	(&memoryAnalysis{instrs: instrs, deps: deps.deps, blocks: blocks, loops: loops}).addMemoryDeps()
+	return deps
+}
+
+// carryInputs returns the program with a copy of every register a loop carries in from before the program, put
+// before the loop. The copies change no value and give the loop a write to carry the register from, like the
+// registers written before it. It returns the pcs of the instructions in the input program too, -1 for the copies.
+func carryInputs(instrs []instruction, deps sectionDeps) ([]instruction, []int) {
+	copies := make(map[int]map[reg]int)
+	for _, read := range deps.carriedOnly {
+		if copies[read.loopStart] == nil {
+			copies[read.loopStart] = make(map[reg]int)
 		}
+		copies[read.loopStart][read.r] = read.body
 	}
 
-	// Fill rest of bb1 keys.
-	for _, instr := range b.bb1 {
-		dep := &deps.deps[instr.pc]
-		_, ops := instr.regs()
-
-		for _, op := range ops {
-			bb0Dep, fromBB0 := bb0Regs[op]
-			bb1Dep, fromBB1 := bb1Regs[op]
-
-			if fromBB0 && fromBB1 {
-				dep.interloopDeps[op] = struct{ init, body int }{bb0Dep, bb1Dep}
-			} else if fromBB0 {
-				dep.loopInvariantDeps[op] = bb0Dep
-			} else if fromBB1 {
-				// Assigned in previous loop pass.
-			} else {
-				// Operand not used previously.
-			}
+	var program []instruction
+	var pcs []int
+	moved := make([]int, len(instrs))
+	for pc, instr := range instrs {
+		for _, r := range sortedRegs(copies[pc]) {
+			program = append(program, instruction{type_: mov, regA: r, regB: r, usesReg: true})
+			pcs = append(pcs, -1)
 		}
+		moved[pc] = len(program)
+		program = append(program, instr)
+		pcs = append(pcs, pc)
 	}
-	deps.bb2Start = len(deps.deps)
-
-	// Add bb2 deps.
-	bb2Regs := make(map[reg]int)
-	for _, instr := range b.bb2 {
-		dep := newDependency()
-		dst, ops := instr.regs()
-
-		for _, op := range ops {
-			if bb2Dep, fromBB2 := bb2Regs[op]; fromBB2 {
-				dep.localDeps[op] = bb2Dep
-			} else if bb1Dep, fromBB1 := bb1Regs[op]; fromBB1 {
-				dep.postLoopDeps[op] = bb1Dep
-			} else if bb0Dep, fromBB0 := bb0Regs[op]; fromBB0 {
-				dep.loopInvariantDeps[op] = bb0Dep
-			} else {
-				// Operand not used previously.
-			}
+	for pc := range program {
+		program[pc].pc = pc
+		if program[pc].type_.isBranch() {
+			// The loops starting at a copy start after it.
+			program[pc].imm = int64(moved[program[pc].imm])
 		}
+	}
+	return program, pcs
+}
 
-		if dst != nil {
-			bb2Regs[*dst] = instr.pc
+// endsBefore reports whether one of the loops ends before the instruction.
+func endsBefore(loops []region, pc int) bool {
+	for _, l := range loops {
+		if l.end <= pc {
+			return true
 		}
-
-		dep.pc = len(deps.deps)
-		deps.deps = append(deps.deps, dep)
 	}
-
-	return deps
+	return false
 }
 
 func (s *Scheduler) Schedule(instructions []string, outputLoop io.Writer, outputLoopPip io.Writer) error {
@@ -227,51 +312,72 @@ func (s *Scheduler) Schedule(instructions []string, outputLoop io.Writer, output
 	if err != nil {
 		return fmt.Errorf("error scheduling, %w", err)
 	}
-
-	// Temporary debug print of decoded instructions
-	fmt.Println("Instructions:")
 	for i, instr := range instrs {
-		var r *reg
-		if i == 0 {
-			r = &reg{type_: predReg, num: 69}
-		}
-		m, err := json.Marshal(specIns{r, instr})
-		if err != nil {
-			return err
+		if err = s.md.checkRegs(instr); err != nil {
+			return fmt.Errorf("error scheduling, instruction %d, %w", i, err)
 		}
-		fmt.Printf("%d: (%s)[%s]%#v\n", i, instructions[i], instr, string(m))
 	}
 
-	blocks := splitIntoBlocks(instrs)
-	deps := s.getDependencies(blocks)
+	regions, err := splitIntoRegions(instrs)
+	if err != nil {
+		return fmt.Errorf("error scheduling, %w", err)
+	}
+	deps := getDependencies(instrs, regions)
 
-	// Temporary debug print of detected deps.
-	fmt.Println()
-	fmt.Println("Dependencies:")
-	for i, dep := range deps.deps {
-		fmt.Printf("(%d)[%c] %v\n", i, 'A'+i, dep)
+	if s.dot != nil {
+		if err = writeDot(s.dot, s.md, instrs, deps); err != nil {
+			return fmt.Errorf("error scheduling, %w", err)
+		}
 	}
 
-	// Loop
-	ls := newLoopScheduler(instrs, deps)
+	// The schedules and their verification read the registers carried in from before the program from copies.
+	instrs, pcs := carryInputs(instrs, deps)
+	if len(deps.carriedOnly) != 0 {
+		if regions, err = splitIntoRegions(instrs); err != nil {
+			return fmt.Errorf("error scheduling, %w", err)
+		}
+		deps = getDependencies(instrs, regions)
+	}
 
-	loopBundles := ls.schedule()
+	// Loop
+	loopBundles, err := s.scheduleLoop(instrs, deps)
+	if err != nil {
+		return fmt.Errorf("error scheduling, %w", err)
+	}
 	if err = outJsonLoop.Encode(loopBundles); err != nil {
 		return fmt.Errorf("error scheduling, %w", err)
 	}
 
 	// LoopPip
-	lps := newLoopPipScheduler(instrs, deps)
-
-	loopPipBundles := lps.schedule()
+	loopPipBundles, err := s.scheduleLoopPip(instrs, deps)
+	if err != nil {
+		return fmt.Errorf("error scheduling, %w", err)
+	}
+	for i := range s.loopBounds {
+		s.loopBounds[i].Loop = pcs[s.loopBounds[i].Loop]
+	}
 	if err = outJsonLoopPip.Encode(loopPipBundles); err != nil {
 		return fmt.Errorf("error scheduling, %w", err)
 	}
-	_ = outJsonLoopPip
+
+	if s.verify {
+		if err = s.verifySchedule("loop", instrs, deps, loopBundles); err != nil {
+			return err
+		}
+		if err = s.verifySchedule("loop.pip", instrs, deps, loopPipBundles); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// New returns a scheduler for the VLIW470, see SetMachine for its variants.
 func New() *Scheduler {
-	return &Scheduler{}
+	return &Scheduler{md: VLIW470()}
+}
+
+// SetMachine sets the machine the instructions are scheduled for.
+func (s *Scheduler) SetMachine(md *MachineDescription) {
+	s.md = md
 }
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"io"
+	"testing"
+)
+
+func TestScheduleCarriedInputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []string
+		loops   []int
+	}{
+		{
+			name:    "recurrence",
+			program: []string{"mov LC, 3", "mov x2, 5", "add x1, x1, x2", "loop 2", "st x1, 0(x2)"},
+			loops:   []int{3},
+		},
+		{
+			name:    "read before the load",
+			program: []string{"mov LC, 3", "mov x2, 5", "addi x6, x1, -3", "ld x1, 0(x2)", "st x6, 8(x2)", "loop 2", "st x1, 0(x2)"},
+			loops:   []int{5},
+		},
+		{
+			name: "second loop",
+			program: []string{"mov LC, 3", "mov x2, 5", "addi x2, x2, 1", "loop 2", "mov LC, 2", "addi x6, x1, -3",
+				"ld x1, 0(x2)", "st x6, 8(x2)", "loop 5", "st x1, 0(x2)"},
+			loops: []int{3, 8},
+		},
+	}
+	for _, tt := range tests {
+		s := New()
+		s.SetVerify(true)
+		if err := s.Schedule(tt.program, io.Discard, io.Discard); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var loops []int
+		for _, b := range s.LoopBounds() {
+			loops = append(loops, b.Loop)
+		}
+		if !equalInts(loops, tt.loops) {
+			t.Errorf("%s: pipelined loops are %v, want %v", tt.name, loops, tt.loops)
+		}
+	}
+}
+
+func mustParse(t *testing.T, program []string) []instruction {
+	t.Helper()
+	instrs, err := parseInstructions(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instrs
+}
+
+func programDeps(t *testing.T, program []string) sectionDeps {
+	t.Helper()
+	instrs := mustParse(t, program)
+	regions, err := splitIntoRegions(instrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return getDependencies(instrs, regions)
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
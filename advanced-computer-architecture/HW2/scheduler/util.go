@@ -1,8 +1,6 @@
 package scheduler
 
-import (
-	"fmt"
-)
+import "fmt"
 
 func (i instruction) regs() (dst *reg, params []reg) {
 	regA := i.regA
@@ -47,70 +45,96 @@ func (i *instruction) mutRegs() (dst *reg, params []*reg) {
 	}
 }
 
-func (it instructionType) isAlu() bool {
+func (it instructionType) isBranch() bool {
 	switch it {
-	case add, addi, sub, mov:
+	case loop, loopPip:
 		return true
 	default:
 		return false
 	}
 }
 
-func (it instructionType) isMul() bool {
-	switch it {
-	case mulu:
-		return true
-	default:
-		return false
-	}
+// region is a range of the program, a basic block or a loop. The body of a loop are the regions before its
+// loop instruction, the last of the loop.
+type region struct {
+	start, end int
+	loop       bool
+	body       []region
 }
 
-func (it instructionType) isMem() bool {
-	switch it {
-	case st, ld:
-		return true
-	default:
+// innermost reports whether the region is a loop without loops in its body.
+func (r region) innermost() bool {
+	if !r.loop {
 		return false
 	}
+	for _, inner := range r.body {
+		if inner.loop {
+			return false
+		}
+	}
+	return true
 }
 
-func (it instructionType) isBranch() bool {
-	switch it {
-	case loop, loopPip:
-		return true
-	default:
-		return false
+// splitIntoRegions splits the program into basic blocks and loops, the loops follow each other or are nested.
+func splitIntoRegions(instrs []instruction) ([]region, error) {
+	// The loop instructions by the start of their loop.
+	loops := make(map[int][]int)
+	numLoops := 0
+	for pc, instr := range instrs {
+		if instr.type_.isBranch() {
+			to := int(instr.imm)
+			if to < 0 || to > pc {
+				return nil, fmt.Errorf("instruction %d loops to %d, not back to the program before it", pc, to)
+			}
+			loops[to] = append(loops[to], pc)
+			numLoops++
+		}
 	}
-}
 
-type blockInstrs struct {
-	bb0 []instruction
-	bb1 []instruction
-	bb2 []instruction
+	regions := buildRegions(loops, 0, len(instrs))
+	if found := countLoops(regions); found != numLoops {
+		return nil, fmt.Errorf("the loops overlap, only %d of the %d loops are nested or follow each other", found, numLoops)
+	}
+	return regions, nil
 }
 
-func splitIntoBlocks(instrs []instruction) blockInstrs {
-	for i, instr := range instrs {
-		if instr.type_.isBranch() {
-			to := instr.imm
-			return blockInstrs{
-				bb0: instrs[:to],
-				bb1: instrs[to : i+1],
-				bb2: instrs[i+1:],
+func buildRegions(loops map[int][]int, start, end int) []region {
+	// The last loop instruction before end of a loop starting at pc, the one of the outer loop.
+	loopAt := func(pc int) int {
+		branch := -1
+		for _, b := range loops[pc] {
+			if b < end {
+				branch = maxInt(branch, b)
 			}
 		}
+		return branch
 	}
 
-	return blockInstrs{
-		bb0: instrs,
+	var regions []region
+	for pc := start; pc < end; {
+		if branch := loopAt(pc); branch != -1 {
+			regions = append(regions, region{start: pc, end: branch + 1, loop: true, body: buildRegions(loops, pc, branch)})
+			pc = branch + 1
+			continue
+		}
+		blockEnd := pc + 1
+		for blockEnd < end && loopAt(blockEnd) == -1 {
+			blockEnd++
+		}
+		regions = append(regions, region{start: pc, end: blockEnd})
+		pc = blockEnd
 	}
+	return regions
 }
 
-func (i instruction) latency() int {
-	if i.type_.isMul() {
-		return 3
+func countLoops(regions []region) int {
+	count := 0
+	for _, r := range regions {
+		if r.loop {
+			count += 1 + countLoops(r.body)
+		}
 	}
-	return 1
+	return count
 }
 
 func maxInt(max int, nums ...int) int {
@@ -122,45 +146,41 @@ func maxInt(max int, nums ...int) int {
 	return max
 }
 
+func minInt(min int, nums ...int) int {
+	for _, num := range nums {
+		if num < min {
+			min = num
+		}
+	}
+	return min
+}
+
 type bundleSlot int8
 
 const noSlot bundleSlot = -1
-const (
-	alu1 bundleSlot = iota
-	alu2
-	mult
-	mem
-	branch
-)
-
-type bundle [5]*specIns
-
-func (b *bundle) addInst(sI *specIns) bundleSlot {
-	if sI.instr.type_.isMul() {
-		if b[mult] == nil {
-			b[mult] = sI
-			return mult
-		}
-	} else if sI.instr.type_.isAlu() {
-		if b[alu1] == nil {
-			b[alu1] = sI
-			return alu1
-		}
-		if b[alu2] == nil {
-			b[alu2] = sI
-			return alu2
-		}
-	} else if sI.instr.type_.isMem() {
-		if b[mem] == nil {
-			b[mem] = sI
-			return mem
+
+// bundle has a slot per functional unit of the machine, the ones past its units stay empty.
+type bundle [maxSlots]*specIns
+
+func (b *bundle) addInst(md *MachineDescription, sI *specIns) bundleSlot {
+	for _, slot := range md.slotsOf(sI.instr.type_) {
+		if b[slot] == nil {
+			b[slot] = sI
+			return slot
 		}
-	} else {
-		panic(fmt.Sprint("Unexpected instruction type to add:", sI.instr.type_))
 	}
 	return noSlot
 }
 
+func (b *bundle) hasSlot(md *MachineDescription, it instructionType) bool {
+	for _, slot := range md.slotsOf(it) {
+		if b[slot] == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *bundle) empty() bool {
 	for _, slot := range b {
 		if slot != nil && slot.instr.type_ != nop {
@@ -183,6 +203,7 @@ func (b *bundle) vTakeSlot(slot bundleSlot) {
 }
 
 type blockBundles struct {
+	md  *MachineDescription
 	bb0 []bundle
 	bb1 []bundle
 	bb2 []bundle
@@ -219,38 +240,36 @@ func (bb *blockBundles) get(idx int) *bundle {
 	panic("Tried to access unreachable bundles idx!")
 }
 
-func (bb *blockBundles) getBlockByStartIdx(bbStartIdx int) *[]bundle {
-	switch bbStartIdx {
-	case bb.bb0Start():
-		return &bb.bb0
-	case bb.bb1Start():
-		return &bb.bb1
-	case bb.bb2Start():
-		return &bb.bb2
+// startOf returns the index of the first bundle of the block, one of bb0, bb1 and bb2.
+func (bb *blockBundles) startOf(block *[]bundle) int {
+	switch block {
+	case &bb.bb0:
+		return bb.bb0Start()
+	case &bb.bb1:
+		return bb.bb1Start()
+	case &bb.bb2:
+		return bb.bb2Start()
 	default:
-		panic("Invalid bbStartIdx")
+		panic("Invalid block")
 	}
 }
 
-func (bb *blockBundles) extend(bbStartIdx int, length int) {
-	bb.extendBlockBy(bbStartIdx, length-bb.len())
+func (bb *blockBundles) extend(block *[]bundle, length int) {
+	bb.extendBlockBy(block, length-bb.len())
 }
 
-func (bb *blockBundles) extendBlockBy(bbStartIdx int, by int) {
-	block := bb.getBlockByStartIdx(bbStartIdx)
+func (bb *blockBundles) extendBlockBy(block *[]bundle, by int) {
 	for i := 0; i < by; i++ {
 		*block = append(*block, bundle{})
 	}
 }
 
-func (bb *blockBundles) trimStart(bbStartIdx int, by int) {
-	block := bb.getBlockByStartIdx(bbStartIdx)
+func (bb *blockBundles) trimStart(block *[]bundle, by int) {
 	copy(*block, (*block)[by:])
 	*block = (*block)[:len(*block)-by]
 }
 
-func (bb *blockBundles) shrinkBlock(bbStartIdx int, blockLength int) {
-	block := bb.getBlockByStartIdx(bbStartIdx)
+func (bb *blockBundles) shrinkBlock(block *[]bundle, blockLength int) {
 	*block = (*block)[:blockLength]
 }
 
@@ -264,7 +283,7 @@ func (bb *blockBundles) bb0AndBB2() []bundle {
 
 func getLoopBundleIdx(bb *blockBundles) int {
 	for i := 0; i < bb.len(); i++ {
-		if bb.get(i)[branch] != nil {
+		if bb.get(i)[bb.md.branch] != nil {
 			return i
 		}
 	}
@@ -0,0 +1,167 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Loop counts the schedules are verified with, on top of the one set by the program.
+var verifyLoopCounts = []uint64{0, 1, 2, 3, 7}
+
+const verifyTrials = 4
+
+// SetVerify enables or disables the check that both schedules compute the same results as the input program.
+func (s *Scheduler) SetVerify(enabled bool) {
+	s.verify = enabled
+}
+
+// verifySchedule runs the input program and the schedule from random initial registers and memory, for several
+// loop counts, and compares the values written by every instruction and the final memory.
+func (s *Scheduler) verifySchedule(name string, instrs []instruction, deps sectionDeps, bundles *blockBundles) error {
+	md := bundles.md
+	scheduled := bundles.all()
+	inputs, err := inputRegs(instrs, deps, scheduled)
+	if err != nil {
+		return fmt.Errorf("error verifying %s schedule, %w", name, err)
+	}
+
+	rnd := rand.New(rand.NewSource(470))
+	loopCounts := append([]*uint64{nil}, make([]*uint64, len(verifyLoopCounts))...)
+	for i := range verifyLoopCounts {
+		loopCounts[i+1] = &verifyLoopCounts[i]
+	}
+
+	for trial := 0; trial < verifyTrials; trial++ {
+		initial := MachineState{Registers: make([]uint64, md.Registers.size())}
+		for i := range initial.Registers {
+			initial.Registers[i] = rnd.Uint64()
+		}
+		seed := rnd.Uint64()
+		fill := func(addr uint64) uint64 {
+			return splitMix64(seed ^ addr)
+		}
+
+		for _, loopCount := range loopCounts {
+			expected := newMachine(md, initial)
+			expected.sequential, expected.fill, expected.loopCount = true, fill, loopCount
+			if err = expected.run(sequentialBundles(md, instrs)); err != nil {
+				return fmt.Errorf("error verifying %s schedule, input program: %w", name, err)
+			}
+
+			scheduledInitial := MachineState{Registers: make([]uint64, md.Registers.size())}
+			for allocated, input := range inputs {
+				scheduledInitial.Registers[allocated.num] = initial.Registers[input.num]
+			}
+			actual := newMachine(md, scheduledInitial)
+			actual.fill, actual.loopCount = fill, loopCount
+			if err = actual.run(scheduled); err != nil {
+				return fmt.Errorf("error verifying %s schedule, %w", name, err)
+			}
+
+			if err = compareRuns(instrs, scheduled, expected, actual); err != nil {
+				if loopCount != nil {
+					err = fmt.Errorf("with LC %d, %w", *loopCount, err)
+				}
+				return fmt.Errorf("error verifying %s schedule, %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// inputRegs maps the registers the schedule reads before writing them to the registers of the input program
+// they were allocated for.
+func inputRegs(instrs []instruction, deps sectionDeps, scheduled []bundle) (map[reg]reg, error) {
+	inputs := make(map[reg]reg)
+	for _, b := range scheduled {
+		for _, sI := range b {
+			if sI == nil || sI.instr.pc == -1 {
+				continue
+			}
+			dep := deps.deps[sI.instr.pc]
+			_, inputOps := instrs[sI.instr.pc].regs()
+			_, ops := sI.instr.regs()
+
+			for i, op := range inputOps {
+				if op.type_ != xReg || dep.dependsOn(op) {
+					continue
+				}
+				if prev, ok := inputs[ops[i]]; ok && prev != op {
+					return nil, fmt.Errorf("%s is read as both %s and %s of the input program", ops[i], prev, op)
+				}
+				inputs[ops[i]] = op
+			}
+		}
+	}
+	return inputs, nil
+}
+
+func (d dependency) dependsOn(r reg) bool {
+	_, local := d.localDeps[r]
+	_, interloop := d.interloopDeps[r]
+	_, invariant := d.loopInvariantDeps[r]
+	_, postLoop := d.postLoopDeps[r]
+	return local || interloop || invariant || postLoop
+}
+
+// compareRuns reports the first instruction of the input program whose written values differ between the runs.
+func compareRuns(instrs []instruction, scheduled []bundle, expected, actual *machine) error {
+	for pc, instr := range instrs {
+		want, got := expected.writes[pc], actual.writes[pc]
+		n := 0
+		for n < len(want) && n < len(got) && want[n] == got[n] {
+			n++
+		}
+		if n == len(want) && n == len(got) {
+			continue
+		}
+
+		idx, sI := findScheduled(scheduled, pc)
+		if sI == nil {
+			return fmt.Errorf("instruction %d (%s) is missing", pc, instr)
+		}
+		if n == len(want) || n == len(got) {
+			return fmt.Errorf("bundle %d (%s) writes %s (%s of the input) %d times instead of %d",
+				idx, sI.instr, sI.instr.regA, instr.regA, len(got), len(want))
+		}
+		return fmt.Errorf("bundle %d (%s) writes %d to %s (%s of the input) in iteration %d instead of %d",
+			idx, sI.instr, got[n], sI.instr.regA, instr.regA, n, want[n])
+	}
+
+	addrs := make([]uint64, 0, len(expected.state.Memory))
+	for addr := range expected.state.Memory {
+		addrs = append(addrs, addr)
+	}
+	for addr := range actual.state.Memory {
+		// The spill slots are the schedule's own.
+		if _, ok := expected.state.Memory[addr]; !ok && addr < spillAddress {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		if expected.load(addr) != actual.load(addr) {
+			return fmt.Errorf("memory at %#x is %d instead of %d", addr, actual.load(addr), expected.load(addr))
+		}
+	}
+	return nil
+}
+
+func findScheduled(scheduled []bundle, pc int) (int, *specIns) {
+	for idx, b := range scheduled {
+		for _, sI := range b {
+			if sI != nil && sI.instr.pc == pc {
+				return idx, sI
+			}
+		}
+	}
+	return -1, nil
+}
+
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
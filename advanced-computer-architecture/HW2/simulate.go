@@ -0,0 +1,58 @@
+package main
+
+import (
+	"HW2/scheduler"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runSimulate executes a schedule on the VLIW470 and prints its final state.
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	initPath := fs.String("init", "", "initial machine state, in the format of the output")
+	maxCycles := fs.Int("max-cycles", 0, "stop schedules that run longer, 0 for the default bound")
+	machinePath := fs.String("machine", "", "machine description, the VLIW470 of the assignment by default")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), os.Args[0]+" simulate [-init </path/to/state.json>] [-max-cycles <n>] [-machine </path/to/machine.json>] </path/to/schedule.json>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	md, err := getMachine(*machinePath)
+	if err != nil {
+		return err
+	}
+
+	var initial scheduler.MachineState
+	if *initPath != "" {
+		data, err := os.ReadFile(*initPath)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(data, &initial); err != nil {
+			return err
+		}
+	}
+
+	schedule, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	final, err := scheduler.Simulate(md, schedule, initial, *maxCycles)
+	if err != nil {
+		return err
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(final)
+}